@@ -0,0 +1,404 @@
+package logpush
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// StreamsAdmin is a REST API for managing ingester streams at runtime.
+//
+// Routes (relative to where it's mounted):
+//
+//	GET /streams
+//	GET /streams/{stream_key}
+//	PUT /streams/{stream_key}
+//	DELETE /streams/{stream_key}
+//	GET /tail
+//	GET /query
+type StreamsAdmin struct {
+	Ingester *LogIngester
+	Store    StreamStore
+	Token    string
+	//	Read-only access: grants GET requests only, so it can be used to search and tail logs but not to change streams
+	ReadToken string
+	//	Live entries for the tail endpoint. It's disabled when not set
+	Tail *TailHub
+	//	Log search for the query endpoint. It's disabled when not set
+	Reader LogReader
+
+	mux     *http.ServeMux
+	muxOnce sync.Once
+
+	//	streams that the ingester had before any runtime changes
+	configStreams     map[string]StreamConfig
+	configStreamsOnce sync.Once
+}
+
+// Shown instead of stream tokens. Sending it back in an update keeps the current token
+const adminMaskedToken = "********"
+
+const (
+	adminStreamOriginConfig = "config"
+	adminStreamOriginAPI    = "api"
+)
+
+// Remembers the streams from the config file, so that deleting them only reverts runtime changes
+func (this *StreamsAdmin) trackConfigStreams() {
+	this.configStreamsOnce.Do(func() {
+		this.configStreams = this.Ingester.ListStreams()
+	})
+}
+
+// Loads persisted streams and applies them on top of the ones that ingester already has
+func (this *StreamsAdmin) Load(ctx context.Context) error {
+
+	this.trackConfigStreams()
+
+	if this.Store == nil {
+		return nil
+	}
+
+	streams, err := this.Store.LoadStreams(ctx)
+	if err != nil {
+		return err
+	}
+
+	for key, val := range streams {
+		this.Ingester.SetStream(key, val)
+	}
+
+	return nil
+}
+
+type adminStreamEntry struct {
+	Key string `json:"key"`
+	//	Where the stream is defined: config (the config file) or api
+	Origin string `json:"origin"`
+	StreamConfig
+}
+
+func (this *StreamsAdmin) streamEntry(key string, stream StreamConfig) adminStreamEntry {
+
+	origin := adminStreamOriginAPI
+	if _, isConfig := this.configStreams[key]; isConfig {
+		origin = adminStreamOriginConfig
+	}
+
+	if stream.Token != "" {
+		stream.Token = adminMaskedToken
+	}
+
+	if stream.ReadToken != "" {
+		stream.ReadToken = adminMaskedToken
+	}
+
+	return adminStreamEntry{Key: key, Origin: origin, StreamConfig: stream}
+}
+
+func (this *StreamsAdmin) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
+
+	this.muxOnce.Do(func() {
+		this.mux = http.NewServeMux()
+		this.mux.HandleFunc("GET /streams", this.handleList)
+		this.mux.HandleFunc("GET /streams/{stream_key}", this.handleGet)
+		this.mux.HandleFunc("PUT /streams/{stream_key}", this.handlePut)
+		this.mux.HandleFunc("DELETE /streams/{stream_key}", this.handleDelete)
+		this.mux.HandleFunc("GET /tail", this.handleTail)
+		this.mux.HandleFunc("GET /query", this.handleQuery)
+	})
+
+	if this.Ingester == nil {
+		adminRespondError(wrt, "no ingester attached", http.StatusInternalServerError)
+		return
+	}
+
+	this.trackConfigStreams()
+
+	switch this.access(req) {
+
+	case adminAccessFull:
+		break
+
+	case adminAccessRead:
+		//	stream listings mask tokens, so every GET route is safe to read
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			slog.Warn("ADMIN Forbidden request with the read token",
+				slog.String("ip", parseXff(req)),
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path))
+			adminRespondError(wrt, "read token can't modify streams", http.StatusForbidden)
+			return
+		}
+
+	default:
+		slog.Warn("ADMIN Unauthorized request",
+			slog.String("ip", parseXff(req)),
+			slog.String("path", req.URL.Path))
+		adminRespondError(wrt, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	this.mux.ServeHTTP(wrt, req)
+}
+
+type adminAccess int
+
+const (
+	adminAccessNone adminAccess = iota
+	adminAccessRead
+	adminAccessFull
+)
+
+func (this *StreamsAdmin) access(req *http.Request) adminAccess {
+
+	//	an admin api without a token is never accessible
+	if this.Token == "" {
+		return adminAccessNone
+	}
+
+	const bearerPrefix = "bearer"
+
+	token := req.Header.Get("Authorization")
+	if !strings.HasPrefix(strings.ToLower(token), bearerPrefix) {
+		return adminAccessNone
+	}
+
+	token = strings.TrimSpace(token[len(bearerPrefix):])
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(this.Token)) == 1 {
+		return adminAccessFull
+	}
+
+	if this.ReadToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(this.ReadToken)) == 1 {
+		return adminAccessRead
+	}
+
+	return adminAccessNone
+}
+
+func (this *StreamsAdmin) handleList(wrt http.ResponseWriter, req *http.Request) {
+
+	streams := this.Ingester.ListStreams()
+
+	entries := []adminStreamEntry{}
+	for key, val := range streams {
+		entries = append(entries, this.streamEntry(key, val))
+	}
+
+	adminRespondJSON(wrt, entries, http.StatusOK)
+}
+
+func (this *StreamsAdmin) handleGet(wrt http.ResponseWriter, req *http.Request) {
+
+	key := strings.ToLower(req.PathValue("stream_key"))
+
+	stream, has := this.Ingester.GetStream(key)
+	if !has {
+		adminRespondError(wrt, fmt.Sprintf("stream '%s' not found", key), http.StatusNotFound)
+		return
+	}
+
+	adminRespondJSON(wrt, this.streamEntry(key, stream), http.StatusOK)
+}
+
+func (this *StreamsAdmin) handlePut(wrt http.ResponseWriter, req *http.Request) {
+
+	key := strings.ToLower(req.PathValue("stream_key"))
+	if err := validateStreamKey(key); err != nil {
+		adminRespondError(wrt, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var stream StreamConfig
+	if err := json.NewDecoder(req.Body).Decode(&stream); err != nil {
+		adminRespondError(wrt, fmt.Sprintf("failed to decode stream: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	current, existed := this.Ingester.GetStream(key)
+
+	//	masked tokens are sent back when updating a stream that was read from this api.
+	//	there must be a token to keep, otherwise the stream would silently lose its auth
+	if stream.Token == adminMaskedToken {
+		if current.Token == "" {
+			adminRespondError(wrt, "masked token can't be used as there's no current token to keep", http.StatusBadRequest)
+			return
+		}
+		stream.Token = current.Token
+	}
+
+	if stream.ReadToken == adminMaskedToken {
+		if current.ReadToken == "" {
+			adminRespondError(wrt, "masked read token can't be used as there's no current read token to keep", http.StatusBadRequest)
+			return
+		}
+		stream.ReadToken = current.ReadToken
+	}
+
+	if this.Store != nil {
+		if err := this.Store.SaveStream(req.Context(), key, stream); err != nil {
+			slog.Error("ADMIN Store.SaveStream",
+				slog.String("store_type", this.Store.Type()),
+				slog.String("key", key),
+				slog.String("err", err.Error()))
+			adminRespondError(wrt, "failed to save stream", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	this.Ingester.SetStream(key, stream)
+
+	slog.Info("ADMIN Stream saved",
+		slog.String("key", key),
+		slog.Bool("created", !existed),
+		slog.Bool("with_token", stream.Token != ""))
+
+	status := http.StatusOK
+	if !existed {
+		status = http.StatusCreated
+	}
+
+	adminRespondJSON(wrt, this.streamEntry(key, stream), status)
+}
+
+func (this *StreamsAdmin) handleDelete(wrt http.ResponseWriter, req *http.Request) {
+
+	key := strings.ToLower(req.PathValue("stream_key"))
+
+	if _, has := this.Ingester.GetStream(key); !has {
+		adminRespondError(wrt, fmt.Sprintf("stream '%s' not found", key), http.StatusNotFound)
+		return
+	}
+
+	configStream, isConfig := this.configStreams[key]
+
+	if this.Store != nil {
+		//	another instance sharing the store could have deleted it already
+		if err := this.Store.DeleteStream(req.Context(), key); err != nil && !errors.Is(err, ErrStreamNotFound) {
+			slog.Error("ADMIN Store.DeleteStream",
+				slog.String("store_type", this.Store.Type()),
+				slog.String("key", key),
+				slog.String("err", err.Error()))
+			adminRespondError(wrt, "failed to delete stream", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	//	config streams can't be deleted, only their runtime changes are reverted
+	if isConfig {
+
+		this.Ingester.SetStream(key, configStream)
+
+		slog.Info("ADMIN Stream reverted to config",
+			slog.String("key", key))
+
+		adminRespondJSON(wrt, this.streamEntry(key, configStream), http.StatusOK)
+		return
+	}
+
+	this.Ingester.DeleteStream(key)
+
+	slog.Info("ADMIN Stream deleted",
+		slog.String("key", key))
+
+	wrt.WriteHeader(http.StatusNoContent)
+}
+
+// Streams new entries of all streams matching the query filter until the client disconnects
+func (this *StreamsAdmin) handleTail(wrt http.ResponseWriter, req *http.Request) {
+
+	if this.Tail == nil {
+		adminRespondError(wrt, "live tail is not enabled", http.StatusNotFound)
+		return
+	}
+
+	filter, err := ParseTailFilter(req.URL.Query())
+	if err != nil {
+		adminRespondError(wrt, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	slog.Info("ADMIN Tail started",
+		slog.String("ip", parseXff(req)),
+		slog.String("tag", filter.Tag))
+
+	serveTail(wrt, req, this.Tail, filter)
+}
+
+func (this *StreamsAdmin) handleQuery(wrt http.ResponseWriter, req *http.Request) {
+
+	if this.Reader == nil {
+		adminRespondError(wrt, "log search is not available with the current writer", http.StatusNotFound)
+		return
+	}
+
+	query, err := ParseLogQuery(req.URL.Query())
+	if err != nil {
+		adminRespondError(wrt, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := this.Reader.Query(req.Context(), query)
+	if errors.Is(err, ErrInvalidQuery) {
+		adminRespondError(wrt, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		slog.Error("ADMIN Query",
+			slog.String("err", err.Error()))
+		adminRespondError(wrt, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	if req.URL.Query().Get("format") != "ndjson" && !strings.Contains(req.Header.Get("accept"), "application/x-ndjson") {
+		adminRespondJSON(wrt, result, http.StatusOK)
+		return
+	}
+
+	if result.NextCursor != "" {
+		wrt.Header().Set("x-next-cursor", result.NextCursor)
+	}
+
+	wrt.Header().Set("content-type", "application/x-ndjson")
+	wrt.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(wrt)
+	for _, entry := range result.Entries {
+		if err := encoder.Encode(entry); err != nil {
+			return
+		}
+	}
+}
+
+func validateStreamKey(key string) error {
+
+	if key == "" {
+		return errors.New("stream key required")
+	}
+
+	if strings.Count(key, streamWildcard) > 1 {
+		return errors.New("stream patterns can only have one wildcard")
+	}
+
+	if key == streamWildcard {
+		return errors.New("stream pattern must have a non-wildcard part")
+	}
+
+	return nil
+}
+
+func adminRespondJSON(wrt http.ResponseWriter, data any, status int) {
+	wrt.Header().Set("content-type", "application/json")
+	wrt.WriteHeader(status)
+	json.NewEncoder(wrt).Encode(data)
+}
+
+func adminRespondError(wrt http.ResponseWriter, message string, status int) {
+	adminRespondJSON(wrt, map[string]string{"error": message}, status)
+}
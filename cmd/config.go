@@ -11,6 +11,16 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// Where the config file is looked up when it's not set explicitly
+var defaultConfigLocations = []string{
+	"./logpush.yml",
+	"/etc/mws/logpush/logpush.yml",
+}
+
+func FindDefaultConfig() (string, bool) {
+	return FindConfig(defaultConfigLocations)
+}
+
 func FindConfig(locations []string) (string, bool) {
 
 	for _, val := range locations {
@@ -62,6 +72,24 @@ func LoadConfigFile(path string) (*FileConfig, error) {
 }
 
 type FileConfig struct {
-	Streams  map[string]logpush.StreamConfig `yaml:"streams" json:"streams"`
-	Ingester logpush.IngesterOptions         `yaml:"ingester" json:"ingester"`
+	Streams   map[string]logpush.StreamConfig `yaml:"streams" json:"streams"`
+	Ingester  logpush.IngesterOptions         `yaml:"ingester" json:"ingester"`
+	Admin     AdminConfig                     `yaml:"admin" json:"admin"`
+	Loki      logpush.LokiOptions             `yaml:"loki" json:"loki"`
+	Timescale logpush.TimescaleOptions        `yaml:"timescale" json:"timescale"`
+}
+
+type AdminConfig struct {
+	//	Bearer token required to access the admin api. The api is disabled when not set
+	Token string `yaml:"token" json:"token"`
+	//	Read-only bearer token for log search and tail, i.e. for the web ui. Can't change streams
+	ReadToken string `yaml:"read_token" json:"read_token"`
+	//	Optional separate listen address for the admin api, i.e. "127.0.0.1:13667"
+	Listen string `yaml:"listen" json:"listen"`
+	//	Where to persist runtime-managed streams (file|timescale)
+	Store string `yaml:"store" json:"store"`
+	//	Stream store file location when using the file store
+	StoreFile string `yaml:"store_file" json:"store_file"`
+	//	Don't serve the web ui at /ui/
+	DisableUI bool `yaml:"disable_ui" json:"disable_ui"`
 }
@@ -26,6 +26,15 @@ func main() {
 
 	godotenv.Load()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "query":
+			os.Exit(runQuery(os.Args[2:]))
+		}
+	}
+
 	cli := CliFlags{
 		Cfg:      flag.String("cfg", "", "config file location"),
 		Debug:    flag.Bool("debug", false, "enable debug logging"),
@@ -43,10 +52,7 @@ func main() {
 	}
 
 	if *cli.Cfg == "" {
-		if loc, has := FindConfig([]string{
-			"./logpush.yml",
-			"/etc/mws/logpush/logpush.yml",
-		}); has {
+		if loc, has := FindDefaultConfig(); has {
 			cli.Cfg = &loc
 		}
 	}
@@ -71,7 +77,7 @@ func main() {
 			slog.Info("Add stream",
 				slog.String("key", key),
 				slog.String("tag", val.Tag),
-
+				slog.Bool("pattern", strings.Contains(key, "*")),
 				slog.Bool("with_token", val.Token != ""))
 		}
 	} else {
@@ -79,9 +85,20 @@ func main() {
 	}
 
 	var writer logpush.LogWriter
+	var streamStore logpush.StreamStore
+	var tailHub logpush.TailHub
+
+	if val := os.Getenv("ADMIN_TOKEN"); val != "" {
+		cfg.Admin.Token = val
+	}
+
+	if val := os.Getenv("ADMIN_READ_TOKEN"); val != "" {
+		cfg.Admin.ReadToken = val
+	}
+
 	if val := os.Getenv("TIMESCALE_URL"); val != "" {
 
-		timescale, err := logpush.NewTimescaleWriter(val)
+		timescale, err := logpush.NewTimescaleWriter(val, cfg.Timescale)
 		if err != nil {
 			fmt.Println("logpush.NewLokiWriter", err)
 			os.Exit(1)
@@ -91,22 +108,63 @@ func main() {
 
 		slog.Info("USING TIMESCALE WRITER")
 
+		if cfg.Admin.Token != "" && cfg.Admin.Store == "timescale" {
+
+			store, err := timescale.StreamStore(context.Background())
+			if err != nil {
+				slog.Error("Failed to set up timescale stream store",
+					slog.String("err", err.Error()))
+				os.Exit(1)
+			}
+
+			streamStore = store
+		}
+
+		if err := timescale.Tail(&tailHub); err != nil {
+			slog.Error("Failed to set up timescale live tail",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
 		writer = timescale
 
 	} else if val := os.Getenv("LOKI_URL"); val != "" {
 
-		loki, err := logpush.NewLokiWriter(val)
+		if val := os.Getenv("LOKI_TENANT"); val != "" {
+			cfg.Loki.Tenant = val
+		}
+
+		if val := os.Getenv("LOKI_BEARER_TOKEN"); val != "" {
+			cfg.Loki.BearerToken = val
+		}
+
+		if val := os.Getenv("LOKI_LAZY_CONNECT"); val != "" {
+			cfg.Loki.LazyConnect = strings.ToLower(val) == "true"
+		}
+
+		loki, err := logpush.NewLokiWriter(val, cfg.Loki)
 		if err != nil {
 			fmt.Println("logpush.NewLokiWriter", err)
 			os.Exit(1)
 		}
 
+		defer loki.Close()
+
 		if val := os.Getenv("LOKI_USE_STRUCT_META"); val != "" {
 			loki.UseStructMeta = strings.ToLower(val) == "true"
 		}
 
+		if val := os.Getenv("LOKI_PUSH_FORMAT"); val != "" {
+			if loki.Format, err = logpush.ParseLokiPushFormat(val); err != nil {
+				slog.Error("Invalid LOKI_PUSH_FORMAT",
+					slog.String("err", err.Error()))
+				os.Exit(1)
+			}
+		}
+
 		slog.Info("USING LOKI WRITER",
-			slog.Bool("with_struct_meta", loki.UseStructMeta))
+			slog.Bool("with_struct_meta", loki.UseStructMeta),
+			slog.String("format", string(loki.Format)))
 
 		writer = loki
 
@@ -115,17 +173,28 @@ func main() {
 		writer = &StdoutWriter{}
 	}
 
+	ingester := logpush.LogIngester{
+		Writer:     writer,
+		Streams:    cfg.Streams,
+		Options:    cfg.Ingester,
+		Tail:       &tailHub,
+		AdminToken: cfg.Admin.Token,
+	}
+
 	var mux http.ServeMux
 
-	mux.Handle("POST /push/stream/{stream_key}", &logpush.LogIngester{
-		Writer:  writer,
-		Streams: cfg.Streams,
-		Options: cfg.Ingester,
-	})
+	mux.Handle("POST /push/stream/{stream_key}", &ingester)
+	mux.HandleFunc("GET /tail/stream/{stream_key}", ingester.ServeTail)
+
+	mux.Handle("GET /metrics", logpush.MetricsHandler())
+
+	health := logpush.HealthHandler{
+		Writers:  []logpush.LogWriter{writer},
+		Ingester: &ingester,
+	}
 
-	mux.HandleFunc("/health", func(wrt http.ResponseWriter, _ *http.Request) {
-		wrt.WriteHeader(http.StatusNoContent)
-	})
+	mux.HandleFunc("/health", health.Health)
+	mux.HandleFunc("/ready", health.Ready)
 
 	port := os.Getenv("PORT")
 	if _, err := strconv.Atoi(port); err != nil || port == "" {
@@ -138,6 +207,84 @@ func main() {
 	}
 
 	errorCh := make(chan error, 1)
+
+	var adminSrv *http.Server
+	if cfg.Admin.Token != "" {
+
+		if cfg.Admin.Store == "file" {
+
+			if cfg.Admin.StoreFile == "" {
+				cfg.Admin.StoreFile = "./logpush-streams.json"
+			}
+
+			store, err := logpush.NewFileStreamStore(cfg.Admin.StoreFile)
+			if err != nil {
+				slog.Error("Failed to set up file stream store",
+					slog.String("err", err.Error()))
+				os.Exit(1)
+			}
+
+			streamStore = store
+
+		} else if streamStore == nil && cfg.Admin.Store != "" {
+			slog.Error("Admin stream store is not available with the current writer",
+				slog.String("store", cfg.Admin.Store))
+			os.Exit(1)
+		}
+
+		reader, _ := writer.(logpush.LogReader)
+
+		admin := logpush.StreamsAdmin{
+			Ingester:  &ingester,
+			Store:     streamStore,
+			Token:     cfg.Admin.Token,
+			ReadToken: cfg.Admin.ReadToken,
+			Tail:      &tailHub,
+			Reader:    reader,
+		}
+
+		if err := admin.Load(context.Background()); err != nil {
+			slog.Error("Failed to load persisted streams",
+				slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+
+		if streamStore == nil {
+			slog.Warn("Admin api has no stream store; changes will be lost on restart")
+		}
+
+		if cfg.Admin.Listen != "" {
+
+			var adminMux http.ServeMux
+			adminMux.Handle("/admin/", http.StripPrefix("/admin", &admin))
+
+			if !cfg.Admin.DisableUI {
+				adminMux.Handle("GET /ui/", uiHandler())
+			}
+
+			adminSrv = &http.Server{
+				Addr:    cfg.Admin.Listen,
+				Handler: &adminMux,
+			}
+
+			go func() {
+				if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+					errorCh <- err
+				}
+			}()
+
+			slog.Info("Starting admin server",
+				slog.String("at", adminSrv.Addr))
+
+		} else {
+			mux.Handle("/admin/", http.StripPrefix("/admin", &admin))
+
+			if !cfg.Admin.DisableUI {
+				mux.Handle("GET /ui/", uiHandler())
+			}
+		}
+	}
+
 	go func() {
 		if err := srv.ListenAndServe(); err != nil {
 			errorCh <- err
@@ -154,6 +301,9 @@ func main() {
 	case <-exitCh:
 		slog.Warn("Shutting down...")
 		srv.Shutdown(context.Background())
+		if adminSrv != nil {
+			adminSrv.Shutdown(context.Background())
+		}
 	case err := <-errorCh:
 		slog.Error("Shutting down...",
 			slog.String("err", err.Error()))
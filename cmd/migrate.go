@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/maddsua/logpush"
+)
+
+// Runs the 'migrate' subcommand: logpush migrate [-cfg path] [-dry_run]
+func runMigrate(args []string) int {
+
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	cfgPath := flags.String("cfg", "", "config file location")
+	dryRun := flags.Bool("dry_run", false, "only list pending migrations")
+	flags.Parse(args)
+
+	dbUrl := os.Getenv("TIMESCALE_URL")
+	if dbUrl == "" {
+		slog.Error("TIMESCALE_URL is not set")
+		return 1
+	}
+
+	if *cfgPath == "" {
+		if loc, has := FindDefaultConfig(); has {
+			cfgPath = &loc
+		}
+	}
+
+	var opts logpush.TimescaleOptions
+
+	if *cfgPath != "" {
+
+		cfg, err := LoadConfigFile(*cfgPath)
+		if err != nil {
+			slog.Error("Failed to load config",
+				slog.String("err", err.Error()))
+			return 1
+		}
+
+		opts = cfg.Timescale
+	}
+
+	timeout := time.Duration(opts.MigrationTimeout)
+	if timeout <= 0 {
+		timeout = time.Hour
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	migrations, err := logpush.MigrateTimescale(ctx, dbUrl, opts, *dryRun)
+
+	for _, val := range migrations {
+		if *dryRun {
+			fmt.Printf("pending: %d %s\n", val.Version, val.Name)
+		} else {
+			fmt.Printf("applied: %d %s\n", val.Version, val.Name)
+		}
+	}
+
+	if err != nil {
+		slog.Error("Migration failed",
+			slog.String("err", err.Error()))
+		return 1
+	}
+
+	if len(migrations) == 0 {
+		fmt.Println("schema is up to date")
+	}
+
+	return 0
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/maddsua/logpush"
+)
+
+type metaFlags map[string]string
+
+func (this metaFlags) String() string {
+	var pairs []string
+	for key, val := range this {
+		pairs = append(pairs, key+"="+val)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (this metaFlags) Set(val string) error {
+
+	key, value, ok := strings.Cut(val, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value")
+	}
+
+	this[key] = value
+	return nil
+}
+
+// Runs the 'query' subcommand that exports or follows entries from whichever backend is configured:
+// logpush query [-cfg path] [-file path] [-from 1h] [-tag app] [-level error,warn] [-meta key=value] [-contains text] [-limit n] [-follow]
+func runQuery(args []string) int {
+
+	meta := metaFlags{}
+
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	cfgPath := flags.String("cfg", "", "config file location")
+	filePath := flags.String("file", "", "read entries from a file written by the file writer instead of the configured backend")
+	from := flags.String("from", "1h", "time range start: RFC3339 date, unix milliseconds or a duration relative to now")
+	to := flags.String("to", "", "time range end")
+	tag := flags.String("tag", "", "stream tag, may contain a wildcard")
+	level := flags.String("level", "", "comma-separated log levels")
+	contains := flags.String("contains", "", "message substring")
+	limit := flags.Int("limit", 100, "max number of entries to export, 0 for no limit")
+	follow := flags.Bool("follow", false, "keep printing new entries as they are written")
+	interval := flags.Duration("interval", 2*time.Second, "polling interval when following")
+	flags.Var(meta, "meta", "metadata filter as key=value, can be repeated")
+	flags.Parse(args)
+
+	params := url.Values{
+		"from":     {*from},
+		"to":       {*to},
+		"tag":      {*tag},
+		"level":    {*level},
+		"contains": {*contains},
+	}
+
+	for key, val := range meta {
+		params.Set("meta."+key, val)
+	}
+
+	query, err := logpush.ParseLogQuery(params)
+	if err != nil {
+		slog.Error("Invalid query",
+			slog.String("err", err.Error()))
+		return 1
+	}
+
+	reader, err := openQueryReader(*cfgPath, *filePath)
+	if err != nil {
+		slog.Error("Failed to open log reader",
+			slog.String("err", err.Error()))
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	encoder := json.NewEncoder(os.Stdout)
+
+	if *follow {
+		err = followQuery(ctx, reader, query, *limit, *interval, encoder)
+	} else {
+		err = exportQuery(ctx, reader, query, *limit, encoder)
+	}
+
+	if err != nil && ctx.Err() == nil {
+		slog.Error("Query failed",
+			slog.String("err", err.Error()))
+		return 1
+	}
+
+	return 0
+}
+
+func openQueryReader(cfgPath string, filePath string) (logpush.LogReader, error) {
+
+	if filePath != "" {
+		return logpush.NewFileReader(filePath)
+	}
+
+	if cfgPath == "" {
+		if loc, has := FindDefaultConfig(); has {
+			cfgPath = loc
+		}
+	}
+
+	var cfg FileConfig
+
+	if cfgPath != "" {
+		loaded, err := LoadConfigFile(cfgPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load config: %v", err)
+		}
+		cfg = *loaded
+	}
+
+	if val := os.Getenv("TIMESCALE_URL"); val != "" {
+		return logpush.NewTimescaleReader(val, cfg.Timescale)
+	}
+
+	if val := os.Getenv("LOKI_URL"); val != "" {
+
+		if val := os.Getenv("LOKI_TENANT"); val != "" {
+			cfg.Loki.Tenant = val
+		}
+
+		if val := os.Getenv("LOKI_BEARER_TOKEN"); val != "" {
+			cfg.Loki.BearerToken = val
+		}
+
+		return logpush.NewLokiReader(val, cfg.Loki)
+	}
+
+	return nil, fmt.Errorf("no backend to read from: set TIMESCALE_URL or LOKI_URL, or pass -file")
+}
+
+// Prints matching entries newest first, page by page
+func exportQuery(ctx context.Context, reader logpush.LogReader, query logpush.LogQuery, limit int, encoder *json.Encoder) error {
+
+	var printed int
+
+	for {
+
+		if limit > 0 {
+			query.Limit = min(limit-printed, 1000)
+		} else {
+			query.Limit = 1000
+		}
+
+		result, err := reader.Query(ctx, query)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range result.Entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+
+		printed += len(result.Entries)
+
+		if result.NextCursor == "" || (limit > 0 && printed >= limit) {
+			return nil
+		}
+
+		query.Cursor = result.NextCursor
+	}
+}
+
+// Prints up to limit latest matching entries oldest first, then polls for new ones
+func followQuery(ctx context.Context, reader logpush.LogReader, query logpush.LogQuery, limit int, interval time.Duration, encoder *json.Encoder) error {
+
+	//	entries with the last printed timestamp, as it's included in the next poll
+	var seen map[string]bool
+	var lastTime time.Time
+
+	var entryKey = func(entry logpush.LogEntry) string {
+		return strings.Join([]string{entry.StreamTag, string(entry.LogLevel), entry.Message}, "\x00")
+	}
+
+	for initial := true; ; initial = false {
+
+		var batch []logpush.LogEntry
+
+		query.Cursor = ""
+		query.Limit = 1000
+
+		if initial && limit > 0 {
+			query.Limit = min(limit, 1000)
+		}
+
+		for {
+
+			result, err := reader.Query(ctx, query)
+			if err != nil {
+				return err
+			}
+
+			batch = append(batch, result.Entries...)
+
+			//	the initial backlog is limited to a single page
+			if result.NextCursor == "" || (initial && limit > 0) {
+				break
+			}
+
+			query.Cursor = result.NextCursor
+		}
+
+		slices.Reverse(batch)
+
+		for _, entry := range batch {
+
+			if entry.Timestamp.Equal(lastTime) && seen[entryKey(entry)] {
+				continue
+			}
+
+			if !entry.Timestamp.Equal(lastTime) {
+				lastTime = entry.Timestamp
+				seen = map[string]bool{}
+			}
+
+			seen[entryKey(entry)] = true
+
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+
+		if !lastTime.IsZero() {
+			query.From = lastTime
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
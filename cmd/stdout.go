@@ -15,6 +15,10 @@ func (this *StdoutWriter) Type() string {
 	return "stdout"
 }
 
+func (this *StdoutWriter) Ping(ctx context.Context) error {
+	return nil
+}
+
 func (this *StdoutWriter) WriteEntry(ctx context.Context, entry logpush.LogEntry) error {
 	slog.Info(fmt.Sprintf("STDOUT %v %s %s", entry.Timestamp, entry.LogLevel.String(), entry.Message))
 	return nil
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+// Serves the log viewer that runs on top of the admin api
+func uiHandler() http.Handler {
+
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+
+	return http.StripPrefix("/ui", http.FileServerFS(files))
+}
@@ -0,0 +1,102 @@
+package logpush
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration option that can be set from both yaml and json configs. Encoded as a go duration string
+// that also accepts days, i.e. "90s" or "7d". Plain numbers are read as nanoseconds
+type Duration time.Duration
+
+func ParseDuration(val string) (Duration, error) {
+
+	if val == "" {
+		return 0, nil
+	}
+
+	if days, isDays := strings.CutSuffix(val, "d"); isDays {
+		count, err := strconv.Atoi(days)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid duration '%s'", val)
+		}
+		return Duration(time.Duration(count) * 24 * time.Hour), nil
+	}
+
+	duration, err := time.ParseDuration(val)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", val)
+	}
+
+	return Duration(duration), nil
+}
+
+func (this Duration) String() string {
+
+	if this == 0 {
+		return ""
+	}
+
+	const day = Duration(24 * time.Hour)
+	if this%day == 0 {
+		return fmt.Sprintf("%dd", this/day)
+	}
+
+	return time.Duration(this).String()
+}
+
+func (this Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.String())
+}
+
+func (this *Duration) UnmarshalJSON(data []byte) error {
+
+	//	plain time.Duration fields used to be encoded as nanoseconds
+	var nanos int64
+	if err := json.Unmarshal(data, &nanos); err == nil {
+		*this = Duration(nanos)
+		return nil
+	}
+
+	var val string
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+
+	parsed, err := ParseDuration(val)
+	if err != nil {
+		return err
+	}
+
+	*this = parsed
+	return nil
+}
+
+func (this Duration) MarshalYAML() (any, error) {
+	return this.String(), nil
+}
+
+func (this *Duration) UnmarshalYAML(node *yaml.Node) error {
+
+	if node.Tag == "!!int" {
+		var nanos int64
+		if err := node.Decode(&nanos); err != nil {
+			return err
+		}
+		*this = Duration(nanos)
+		return nil
+	}
+
+	parsed, err := ParseDuration(node.Value)
+	if err != nil {
+		return err
+	}
+
+	*this = parsed
+	return nil
+}
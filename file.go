@@ -0,0 +1,133 @@
+package logpush
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Creates a writer that appends entries to a local file as newline-delimited json
+func NewFileWriter(path string) (*fileWriter, error) {
+
+	if path == "" {
+		return nil, fmt.Errorf("file path is not defined")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileWriter{fileReader: fileReader{path: path}, file: file}, nil
+}
+
+type fileWriter struct {
+	fileReader
+	mtx  sync.Mutex
+	file *os.File
+}
+
+func (this *fileWriter) Type() string {
+	return "file"
+}
+
+func (this *fileWriter) Ping(ctx context.Context) error {
+	_, err := this.file.Stat()
+	return err
+}
+
+func (this *fileWriter) Close() error {
+	return this.file.Close()
+}
+
+func (this *fileWriter) WriteEntry(ctx context.Context, entry LogEntry) error {
+	return this.WriteBatch(ctx, []LogEntry{entry})
+}
+
+func (this *fileWriter) WriteBatch(ctx context.Context, batch []LogEntry) error {
+
+	var buff bytes.Buffer
+	encoder := json.NewEncoder(&buff)
+
+	for _, entry := range batch {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	_, err := this.file.Write(buff.Bytes())
+	return err
+}
+
+// Creates a reader for files written by the file writer
+func NewFileReader(path string) (*fileReader, error) {
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return &fileReader{path: path}, nil
+}
+
+type fileReader struct {
+	path string
+}
+
+// Scans the whole file, so it's only suitable for reasonably small ones
+func (this *fileReader) Query(ctx context.Context, query LogQuery) (*LogQueryResult, error) {
+
+	file, err := os.Open(this.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	cursor, err := parseQueryCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []LogEntry
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		//	entries past the cursor are never needed
+		if cursor != nil && entry.Timestamp.After(cursor.Time) {
+			continue
+		}
+
+		if query.Match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return pageQueryEntries(entries, query)
+}
@@ -0,0 +1,115 @@
+package logpush
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthHandler reports the service state by checking all the attached writers
+type HealthHandler struct {
+	Writers  []LogWriter
+	Ingester *LogIngester
+	//	Timeout for writer pings. Defaults to 5 seconds
+	Timeout time.Duration
+}
+
+type HealthReport struct {
+	Status         string         `json:"status"`
+	PendingEntries int            `json:"pending_entries"`
+	Writers        []WriterHealth `json:"writers"`
+}
+
+type WriterHealth struct {
+	Type       string `json:"type"`
+	Ok         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
+	QueueDepth *int   `json:"queue_depth,omitempty"`
+}
+
+func (this *HealthHandler) Check(ctx context.Context) HealthReport {
+
+	timeout := this.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	report := HealthReport{
+		Status:  "ok",
+		Writers: make([]WriterHealth, len(this.Writers)),
+	}
+
+	if this.Ingester != nil {
+		report.PendingEntries = this.Ingester.PendingEntries()
+	}
+
+	var wg sync.WaitGroup
+
+	for idx, writer := range this.Writers {
+
+		wg.Add(1)
+
+		go func(idx int, writer LogWriter) {
+
+			defer wg.Done()
+
+			started := time.Now()
+
+			health := WriterHealth{Type: writer.Type(), Ok: true}
+
+			if err := writer.Ping(ctx); err != nil {
+				health.Ok = false
+				health.Error = err.Error()
+			}
+
+			health.LatencyMs = time.Since(started).Milliseconds()
+
+			if queued, ok := writer.(QueuedWriter); ok {
+				depth := queued.QueueDepth()
+				health.QueueDepth = &depth
+			}
+
+			report.Writers[idx] = health
+
+		}(idx, writer)
+	}
+
+	wg.Wait()
+
+	for _, val := range report.Writers {
+		if !val.Ok {
+			report.Status = "degraded"
+			break
+		}
+	}
+
+	return report
+}
+
+// Always responds with 200 as long as the service is running, includes a full health report
+func (this *HealthHandler) Health(wrt http.ResponseWriter, req *http.Request) {
+	wrt.Header().Set("content-type", "application/json")
+	wrt.WriteHeader(http.StatusOK)
+	json.NewEncoder(wrt).Encode(this.Check(req.Context()))
+}
+
+// Responds with 503 when any of the writers is not available
+func (this *HealthHandler) Ready(wrt http.ResponseWriter, req *http.Request) {
+
+	report := this.Check(req.Context())
+
+	status := http.StatusOK
+	if report.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	wrt.Header().Set("content-type", "application/json")
+	wrt.WriteHeader(status)
+	json.NewEncoder(wrt).Encode(report)
+}
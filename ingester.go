@@ -7,7 +7,10 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -18,6 +21,15 @@ type StreamConfig struct {
 	Tag    string            `yaml:"tag" json:"tag"`
 	Token  string            `yaml:"token" json:"token"`
 	Labels map[string]string `yaml:"labels" json:"labels"`
+
+	//	Grants access to the stream's live tail. Push tokens never do; streams without it can only be tailed with the admin token
+	ReadToken string `yaml:"read_token" json:"read_token,omitempty"`
+
+	//	Only used by pattern streams: writes the part of the stream key matched by the wildcard into this label
+	MatchLabel string `yaml:"match_label" json:"match_label"`
+
+	//	How long the stream's entries are kept, i.e. "7d". Uses the writer's global retention when not set
+	Retention Duration `yaml:"retention" json:"retention,omitempty"`
 }
 
 type IngesterOptions struct {
@@ -36,8 +48,21 @@ type LogIngester struct {
 	Writer  LogWriter
 	Options IngesterOptions
 	Streams map[string]StreamConfig
+	//	Receives every written entry for live tailing
+	Tail *TailHub
+	//	Grants access to the live tail of every stream
+	AdminToken string
 
 	optionsValid bool
+	streamsMtx   sync.RWMutex
+	patterns     []streamPattern[StreamConfig]
+
+	pendingEntries atomic.Int64
+}
+
+// Returns the number of accepted entries that are still being written
+func (this *LogIngester) PendingEntries() int {
+	return int(this.pendingEntries.Load())
 }
 
 func (this *LogIngester) validateOptions() {
@@ -62,6 +87,10 @@ func (this *LogIngester) validateOptions() {
 		this.Options.MaxMetadataSize = 16 * 1024
 	}
 
+	this.streamsMtx.Lock()
+	this.patterns = compileStreamPatterns(this.Streams)
+	this.streamsMtx.Unlock()
+
 	this.optionsValid = true
 }
 
@@ -72,71 +101,56 @@ func (this *LogIngester) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 	}
 
 	clientIP := parseXff(req)
+	streamKey := strings.ToLower(req.PathValue("stream_key"))
+
+	//	pattern streams are reported under the pattern key to keep metrics cardinality in check
+	metricsStream := metricsUnknownStream
 
-	var respondError = func(message string, status int) {
+	var respondError = func(code string, message string, status int) {
 
-		if status < http.StatusOK {
+		if status < http.StatusBadRequest {
 			status = http.StatusBadRequest
 		}
 
 		slog.Error("INGESTER http request",
 			slog.String("ip", clientIP),
+			slog.String("stream_id", streamKey),
+			slog.Int("status", status),
 			slog.String("err", message))
 
-		wrt.Header().Set("content-type", "text/plain")
-		wrt.WriteHeader(http.StatusBadRequest)
-		wrt.Write([]byte(message + "\r\n"))
+		metricIngesterRequests.WithLabelValues(metricsStream, strconv.Itoa(status)).Inc()
+
+		wrt.Header().Set("content-type", "application/json")
+		wrt.WriteHeader(status)
+		json.NewEncoder(wrt).Encode(IngesterError{
+			Code:    code,
+			Message: message,
+			Stream:  streamKey,
+		})
 	}
 
 	if this.Writer == nil {
-		respondError("no available writer", http.StatusInternalServerError)
+		respondError("no_writer", "no available writer", http.StatusInternalServerError)
 		return
 	}
 
-	if len(this.Options.BasicAuth) > 0 {
-
-		if user, pass, has := req.BasicAuth(); !has {
-			respondError("authorization required", http.StatusUnauthorized)
-			return
-		} else if expectPass, hasUser := this.Options.BasicAuth[user]; !hasUser || pass != expectPass {
-			time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
-			respondError("invalid credentials", http.StatusForbidden)
-			return
-		}
+	//	a literal pattern key would match its own pattern
+	if strings.Contains(streamKey, streamWildcard) {
+		respondError("invalid_stream", "stream id can't contain wildcards", http.StatusBadRequest)
+		return
 	}
 
-	streamKey := strings.ToLower(req.PathValue("stream_key"))
-	if streamKey == "" {
-		respondError("stream id required", http.StatusBadRequest)
-		return
+	stream, configKey, authErr := this.authorizeStream(req, streamKey)
+	if configKey != "" {
+		metricsStream = configKey
 	}
 
-	stream, has := this.Streams[streamKey]
-	if !has {
-		respondError(fmt.Sprintf("stream '%s' not found", streamKey), http.StatusNotFound)
+	if authErr != nil {
+		respondError(authErr.Code, authErr.Message, authErr.status)
 		return
 	}
 
-	if stream.Token != "" {
-
-		const bearerPrefix = "bearer"
-
-		clientToken := req.Header.Get("Authorization")
-		if strings.HasPrefix(strings.ToLower(clientToken), bearerPrefix) {
-			clientToken = strings.TrimSpace(clientToken[len(bearerPrefix):])
-		} else {
-			clientToken = req.URL.Query().Get("token")
-		}
-
-		if clientToken == "" {
-			respondError(fmt.Sprintf("auth token required for stream '%s'", streamKey), http.StatusUnauthorized)
-			return
-		} else if clientToken != stream.Token {
-			time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
-			respondError(fmt.Sprintf("auth token rejected for stream '%s'", streamKey), http.StatusForbidden)
-			return
-		}
-	}
+	var summary IngesterSummary
 
 	contentType := req.Header.Get("content-type")
 	switch {
@@ -145,7 +159,7 @@ func (this *LogIngester) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 
 		var batch IngesterBatch
 		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
-			respondError(fmt.Sprintf("failed to decode batch: %v", err), http.StatusBadRequest)
+			respondError("invalid_batch", fmt.Sprintf("failed to decode batch: %v", err), http.StatusBadRequest)
 			return
 		}
 
@@ -167,6 +181,8 @@ func (this *LogIngester) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 				slog.Int("trunc", this.Options.MaxEntries),
 				slog.String("ip", clientIP),
 				slog.String("stream_id", streamKey))
+			summary.TruncatedEntries = len(batch.Entries) - this.Options.MaxEntries
+			metricIngesterTruncations.WithLabelValues(metricsStream, "entries").Add(float64(summary.TruncatedEntries))
 			batch.Entries = batch.Entries[:this.Options.MaxEntries]
 		}
 
@@ -197,12 +213,25 @@ func (this *LogIngester) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 			indexLabels(batch.Meta)
 
 			//	copy entry labels if still have space left
+			var droppedFields int
 			for key, val := range entry.Meta {
 				if canAddField(key, val) {
 					copyField(key, val)
+				} else {
+					droppedFields++
 				}
 			}
 
+			if droppedFields > 0 {
+				slog.Warn("INGESTER Metadata truncated",
+					slog.Int("dropped_fields", droppedFields),
+					slog.Int("trunc", this.Options.MaxMetadataSize),
+					slog.String("ip", clientIP),
+					slog.String("stream_id", streamKey))
+				summary.DroppedMetadataFields += droppedFields
+				metricIngesterTruncations.WithLabelValues(metricsStream, "metadata").Add(float64(droppedFields))
+			}
+
 			//	write batch labels over entry meta
 			for key, val := range batch.Meta {
 				copyField(key, val)
@@ -226,6 +255,8 @@ func (this *LogIngester) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 					slog.Int("trunc", this.Options.MaxMessageSize),
 					slog.String("ip", clientIP),
 					slog.String("stream_id", streamKey))
+				summary.TruncatedMessages++
+				metricIngesterTruncations.WithLabelValues(metricsStream, "message").Inc()
 				entry.Message = entry.Message[:this.Options.MaxMessageSize] + "..."
 			}
 
@@ -234,31 +265,154 @@ func (this *LogIngester) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
 				streamTag = streamKey
 			}
 
+			logLevel := LogLevel(entry.Level)
+
 			entries = append(entries, LogEntry{
-				Timestamp: timestamp,
-				StreamTag: streamTag,
-				LogLevel:  LogLevel(entry.Level),
-				Message:   entry.Message,
-				Metadata:  meta,
+				Timestamp:    timestamp,
+				StreamKey:    streamKey,
+				StreamTag:    streamTag,
+				LogLevel:     logLevel,
+				Message:      entry.Message,
+				Metadata:     meta,
+				StreamLabels: stream.Labels,
+				Retention:    time.Duration(stream.Retention),
 			})
+
+			metricIngesterEntries.WithLabelValues(metricsStream, logLevel.String()).Inc()
+			metricIngesterBytes.WithLabelValues(metricsStream, logLevel.String()).Add(float64(len(entry.Message)))
 		}
 
+		summary.Accepted = len(entries)
+
+		metricIngesterLastEntry.WithLabelValues(metricsStream).SetToCurrentTime()
+
+		this.pendingEntries.Add(int64(len(entries)))
+
 		go func() {
-			if err := this.Writer.WriteBatch(context.Background(), entries); err != nil {
+
+			defer this.pendingEntries.Add(-int64(len(entries)))
+
+			started := time.Now()
+
+			var queued bool
+			var err error
+
+			//	tail viewers only get entries that were actually stored,
+			//	which for a deferred writer may happen long after this call returns
+			if deferred, ok := this.Writer.(DeferredWriter); ok {
+				queued, err = deferred.WriteDeferred(context.Background(), entries, this.publishTail)
+			} else {
+				err = this.Writer.WriteBatch(context.Background(), entries)
+			}
+
+			if !queued {
+				metricWriterBatchDuration.WithLabelValues(this.Writer.Type()).Observe(time.Since(started).Seconds())
+			}
+
+			if err != nil {
+				metricWriterErrors.WithLabelValues(this.Writer.Type()).Inc()
 				slog.Error("INGESTER Writer.WriteBatch",
 					slog.String("writer_type", this.Writer.Type()),
 					slog.String("err", err.Error()))
+				return
+			}
+
+			if !queued {
+				this.publishTail(entries)
 			}
 		}()
 
 	default:
-		respondError("unsupported content type", http.StatusNotAcceptable)
+		respondError("unsupported_content_type", "unsupported content type", http.StatusUnsupportedMediaType)
 		return
 	}
 
+	//	clients opt into the summary by accepting json
+	if strings.Contains(req.Header.Get("accept"), "application/json") {
+		metricIngesterRequests.WithLabelValues(metricsStream, strconv.Itoa(http.StatusOK)).Inc()
+		wrt.Header().Set("content-type", "application/json")
+		wrt.WriteHeader(http.StatusOK)
+		json.NewEncoder(wrt).Encode(summary)
+		return
+	}
+
+	metricIngesterRequests.WithLabelValues(metricsStream, strconv.Itoa(http.StatusNoContent)).Inc()
+
 	wrt.WriteHeader(http.StatusNoContent)
 }
 
+func (this *LogIngester) publishTail(entries []LogEntry) {
+	if this.Tail != nil {
+		this.Tail.Publish(entries)
+	}
+}
+
+type ingesterAuthError struct {
+	IngesterError
+	status int
+}
+
+// Resolves the request stream and checks its credentials.
+// The stream config key is returned whenever the stream was found, even if the auth has failed
+func (this *LogIngester) authorizeStream(req *http.Request, streamKey string) (StreamConfig, string, *ingesterAuthError) {
+
+	var authError = func(code string, message string, status int) *ingesterAuthError {
+		return &ingesterAuthError{
+			IngesterError: IngesterError{Code: code, Message: message, Stream: streamKey},
+			status:        status,
+		}
+	}
+
+	if len(this.Options.BasicAuth) > 0 {
+
+		if user, pass, has := req.BasicAuth(); !has {
+			metricIngesterAuthFailures.WithLabelValues(metricsUnknownStream, "basic").Inc()
+			return StreamConfig{}, "", authError("auth_required", "authorization required", http.StatusUnauthorized)
+		} else if expectPass, hasUser := this.Options.BasicAuth[user]; !hasUser || pass != expectPass {
+			metricIngesterAuthFailures.WithLabelValues(metricsUnknownStream, "basic").Inc()
+			time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+			return StreamConfig{}, "", authError("invalid_credentials", "invalid credentials", http.StatusForbidden)
+		}
+	}
+
+	if streamKey == "" {
+		return StreamConfig{}, "", authError("stream_required", "stream id required", http.StatusBadRequest)
+	}
+
+	stream, configKey, has := this.lookupStream(streamKey)
+	if !has {
+		return StreamConfig{}, "", authError("stream_not_found", fmt.Sprintf("stream '%s' not found", streamKey), http.StatusNotFound)
+	}
+
+	if stream.Token != "" {
+
+		clientToken := requestToken(req)
+
+		if clientToken == "" {
+			metricIngesterAuthFailures.WithLabelValues(configKey, "token").Inc()
+			return stream, configKey, authError("token_required", fmt.Sprintf("auth token required for stream '%s'", streamKey), http.StatusUnauthorized)
+		} else if clientToken != stream.Token {
+			metricIngesterAuthFailures.WithLabelValues(configKey, "token").Inc()
+			time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+			return stream, configKey, authError("token_rejected", fmt.Sprintf("auth token rejected for stream '%s'", streamKey), http.StatusForbidden)
+		}
+	}
+
+	return stream, configKey, nil
+}
+
+// Returns the bearer token from the authorization header or the token url param
+func requestToken(req *http.Request) string {
+
+	const bearerPrefix = "bearer"
+
+	if token := req.Header.Get("Authorization"); strings.HasPrefix(strings.ToLower(token), bearerPrefix) {
+		return strings.TrimSpace(token[len(bearerPrefix):])
+	}
+
+	return req.URL.Query().Get("token")
+}
+
 func parseXff(req *http.Request) string {
 	if xff := req.Header.Get("x-forwarded-for"); xff != "" {
 		return xff
@@ -268,6 +422,19 @@ func parseXff(req *http.Request) string {
 	return req.RemoteAddr
 }
 
+type IngesterError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Stream  string `json:"stream,omitempty"`
+}
+
+type IngesterSummary struct {
+	Accepted              int `json:"accepted"`
+	TruncatedEntries      int `json:"truncated_entries"`
+	TruncatedMessages     int `json:"truncated_messages"`
+	DroppedMetadataFields int `json:"dropped_metadata_fields"`
+}
+
 type IngesterBatch struct {
 	Meta    map[string]string `json:"meta"`
 	Entries []IngesterEntry   `json:"entries"`
@@ -8,21 +8,46 @@ import (
 
 type LogWriter interface {
 	Type() string
+	//	Checks if the writer's backend is reachable
+	Ping(ctx context.Context) error
 	WriteEntry(ctx context.Context, entry LogEntry) error
 	WriteBatch(ctx context.Context, batch []LogEntry) error
 }
 
+// Implemented by writers that hold entries in memory or on disk before writing them out
+type QueuedWriter interface {
+	QueueDepth() int
+}
+
+// Implemented by writers that can hold a batch back instead of writing it out right away
+type DeferredWriter interface {
+	//	Writes a batch or queues it for later, reporting which one it did.
+	//	Queued batches are passed to onWritten once they're actually written out
+	WriteDeferred(ctx context.Context, batch []LogEntry, onWritten func(batch []LogEntry)) (bool, error)
+}
+
+// Implemented by writers that can search the entries they've written
+type LogReader interface {
+	Query(ctx context.Context, query LogQuery) (*LogQueryResult, error)
+}
+
 type LogEntry struct {
 	//	Entry creation date
-	Timestamp time.Time
+	Timestamp time.Time `json:"time"`
+	//	Key of the stream that the entry was pushed to, only set for entries coming from the ingester
+	StreamKey string `json:"-"`
 	//	Unique log stream tag
-	StreamTag string
+	StreamTag string `json:"tag"`
 	//	Log level (error|log|info|debug)
-	LogLevel LogLevel
+	LogLevel LogLevel `json:"level"`
 	//	The actual log message
-	Message string
+	Message string `json:"message"`
 	//	Optional metadata in KV format
-	Metadata map[string]string
+	Metadata map[string]string `json:"meta,omitempty"`
+	//	Labels set by the stream config. Unlike the rest of the metadata, clients can't control them
+	StreamLabels map[string]string `json:"-"`
+	//	Stream retention period, zero when not set
+	Retention time.Duration `json:"-"`
 }
 
 type LogLevel string
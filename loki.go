@@ -2,15 +2,24 @@ package logpush
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/golang/snappy"
 )
 
 type LokiStream struct {
@@ -23,6 +32,9 @@ type LokiStreamValue struct {
 	Timestamp          time.Time
 	LogLine            string
 	StructuredMetadata map[string]string
+
+	//	the original entry that this value was created from
+	entry LogEntry
 }
 
 func (this LokiStreamValue) MarshalJSON() ([]byte, error) {
@@ -39,15 +51,173 @@ func (this LokiStreamValue) MarshalJSON() ([]byte, error) {
 	return json.Marshal(line)
 }
 
+type LokiPushFormat string
+
+const (
+	//	Plain json, the default
+	LokiFormatJSON LokiPushFormat = "json"
+	//	Gzip-compressed json
+	LokiFormatGzip LokiPushFormat = "gzip"
+	//	Snappy-compressed protobuf, the most efficient one
+	LokiFormatProtobuf LokiPushFormat = "protobuf"
+)
+
+func ParseLokiPushFormat(val string) (LokiPushFormat, error) {
+	switch format := LokiPushFormat(strings.ToLower(val)); format {
+	case "":
+		return LokiFormatJSON, nil
+	case LokiFormatJSON, LokiFormatGzip, LokiFormatProtobuf:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported loki push format '%s'", val)
+	}
+}
+
 type LokiLabelTransformer func(val string) (newKey string, newValue string)
 
-func lokiRenameLabel(newKey string) LokiLabelTransformer {
-	return func(val string) (string, string) {
-		return newKey, val
+type LokiOptions struct {
+	//	Default tenant id sent as X-Scope-OrgID
+	Tenant string `yaml:"tenant" json:"tenant"`
+	//	Maps stream tags to tenant ids. Keys may contain a wildcard, i.e. "web-pr-*"
+	StreamTenants map[string]string `yaml:"stream_tenants" json:"stream_tenants"`
+	//	When set, the value of this stream config label is used as the tenant id.
+	//	Labels sent by clients are never used for this
+	TenantLabel string `yaml:"tenant_label" json:"tenant_label"`
+	//	When set, streams with a retention period get it as a label with this name, i.e. retention="7d"
+	RetentionLabel string `yaml:"retention_label" json:"retention_label"`
+	//	Bearer token for the loki api
+	BearerToken string `yaml:"bearer_token" json:"bearer_token"`
+	//	Custom headers added to every loki api request
+	Headers map[string]string `yaml:"headers" json:"headers"`
+	//	Label extraction rules
+	Labels LokiLabelOptions `yaml:"labels" json:"labels"`
+	//	Protects loki from labels with too many distinct values
+	Cardinality LokiCardinalityOptions `yaml:"cardinality" json:"cardinality"`
+	//	Api call retry policy
+	Retry LokiRetryOptions `yaml:"retry" json:"retry"`
+	//	Handling of entries rejected for being too old or out of order
+	Reject LokiRejectOptions `yaml:"reject" json:"reject"`
+	//	Don't wait for loki on startup, queue writes until it becomes available
+	LazyConnect bool `yaml:"lazy_connect" json:"lazy_connect"`
+	//	Max number of entries queued while loki is unavailable. Defaults to 100000
+	QueueSize int `yaml:"queue_size" json:"queue_size"`
+	//	Max entries per search query, must not exceed loki's max_entries_limit_per_query. Defaults to 5000
+	MaxQueryEntries int `yaml:"max_query_entries" json:"max_query_entries"`
+	//	How often to check for loki availability in lazy mode. Defaults to 5s
+	ProbeInterval Duration `yaml:"probe_interval" json:"probe_interval"`
+}
+
+type LokiRetryOptions struct {
+	//	Max number of attempts per api call. Defaults to 10
+	Attempts int `yaml:"attempts" json:"attempts"`
+	//	Delay before the first retry. Defaults to 100ms
+	MinDelay Duration `yaml:"min_delay" json:"min_delay"`
+	//	Backoff delay cap. Defaults to 30s
+	MaxDelay Duration `yaml:"max_delay" json:"max_delay"`
+	//	Stop retrying after this much time has passed since the first attempt. Defaults to 2m
+	MaxElapsed Duration `yaml:"max_elapsed" json:"max_elapsed"`
+}
+
+func (this LokiRetryOptions) withDefaults() LokiRetryOptions {
+
+	if this.Attempts <= 0 {
+		this.Attempts = 10
+	}
+
+	if this.MinDelay <= 0 {
+		this.MinDelay = Duration(100 * time.Millisecond)
+	}
+
+	if this.MaxDelay <= 0 {
+		this.MaxDelay = Duration(30 * time.Second)
+	}
+
+	if this.MaxDelay < this.MinDelay {
+		this.MaxDelay = this.MinDelay
+	}
+
+	if this.MaxElapsed <= 0 {
+		this.MaxElapsed = Duration(2 * time.Minute)
+	}
+
+	return this
+}
+
+// Exponential backoff with jitter: a random delay between half and the full exponential step
+func (this LokiRetryOptions) backoff(attempt int) time.Duration {
+
+	delay := time.Duration(this.MaxDelay)
+	if attempt < 32 {
+		if step := time.Duration(this.MinDelay) << attempt; step > 0 && step < delay {
+			delay = step
+		}
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Parses the Retry-After header that can either be in seconds or an http date
+func parseRetryAfter(val string) time.Duration {
+
+	if val == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(val); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+
+	if date, err := http.ParseTime(val); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
+
+func NewLokiWriter(lokiUrl string, opts LokiOptions) (*lokiWriter, error) {
+
+	this, err := newLokiWriter(lokiUrl, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch opts.Reject.Action {
+	case "", lokiRejectDrop, lokiRejectClamp:
+		break
+	case lokiRejectDeadLetter:
+		if this.deadLetter, err = NewFileWriter(opts.Reject.DeadLetterFile); err != nil {
+			return nil, fmt.Errorf("unable to open dead letter file: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported reject action '%s'", opts.Reject.Action)
+	}
+
+	if opts.LazyConnect {
+		this.startProbing()
+		return this, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := this.ping(ctx); err != nil {
+		return nil, fmt.Errorf("unable to connect: %s", err.Error())
 	}
+
+	this.ready.Store(true)
+
+	return this, nil
+}
+
+// Creates a loki client for queries only, without connecting to loki or opening anything used for writes
+func NewLokiReader(lokiUrl string, opts LokiOptions) (*lokiWriter, error) {
+	return newLokiWriter(lokiUrl, opts)
 }
 
-func NewLokiWriter(lokiUrl string) (*lokiWriter, error) {
+func newLokiWriter(lokiUrl string, opts LokiOptions) (*lokiWriter, error) {
 
 	baseURL, err := url.Parse(lokiUrl)
 	if err != nil {
@@ -69,34 +239,29 @@ func NewLokiWriter(lokiUrl string) (*lokiWriter, error) {
 
 	query := baseURL.Query()
 
-	this := lokiWriter{
+	format, err := ParseLokiPushFormat(query.Get("format"))
+	if err != nil {
+		return nil, err
+	}
+
+	extractLabels, err := opts.Labels.Transformers()
+	if err != nil {
+		return nil, err
+	}
+
+	return &lokiWriter{
 		baseURL: url.URL{
 			Scheme: baseURL.Scheme,
 			Host:   baseURL.Host,
 			User:   baseURL.User,
 		},
-		UseStructMeta: query.Get("labels") == "struct",
-		ExtractLabels: map[string]LokiLabelTransformer{
-			"level":       nil,
-			"ip":          nil,
-			"remote_addr": lokiRenameLabel("ip"),
-			"client_ip":   lokiRenameLabel("ip"),
-			"rid":         nil,
-			"request_id":  lokiRenameLabel("rid"),
-			"org":         nil,
-			"app":         nil,
-			"env":         nil,
-			"environment": lokiRenameLabel("env"),
-			"service":     nil,
-			"scope":       nil,
-		},
-	}
-
-	if err := this.Ping(); err != nil {
-		return nil, fmt.Errorf("unable to connect: %s", err.Error())
-	}
-
-	return &this, err
+		UseStructMeta:  query.Get("labels") == "struct",
+		Format:         format,
+		Options:        opts,
+		ExtractLabels:  extractLabels,
+		cardinality:    newLokiCardinalityGuard(opts.Cardinality),
+		tenantPatterns: compileStreamPatterns(opts.StreamTenants),
+	}, nil
 }
 
 type lokiWriter struct {
@@ -105,26 +270,57 @@ type lokiWriter struct {
 	//	Use structured metadata
 	UseStructMeta bool
 
+	//	Push payload encoding
+	Format LokiPushFormat
+
+	Options LokiOptions
+
 	//	Extract these labels when structured metadata is enabled
 	ExtractLabels map[string]LokiLabelTransformer
+
+	cardinality    *lokiCardinalityGuard
+	deadLetter     LogWriter
+	tenantPatterns []streamPattern[string]
+
+	ready       atomic.Bool
+	queueMtx    sync.Mutex
+	queue       []lokiQueuedBatch
+	queueDepth  int
+	probeCancel context.CancelFunc
+
+	sequenceMtx     sync.Mutex
+	sequenceCursors map[string]int64
 }
 
 func (this *lokiWriter) Type() string {
 	return "loki"
 }
 
-func (this *lokiWriter) fetch(ctx context.Context, method string, url url.URL, headers http.Header, body io.Reader) (*http.Response, error) {
+func (this *lokiWriter) fetch(ctx context.Context, method string, url url.URL, headers http.Header, body []byte) (*http.Response, error) {
 
-	const attempts = 10
-	const attemptDelay = 100 * time.Millisecond
+	policy := this.Options.Retry.withDefaults()
 
 	var doFetch = func() (*http.Response, error) {
 
-		req, err := http.NewRequest(method, url.String(), body)
+		//	the body reader has to be recreated for every attempt as the previous one is already consumed
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequest(method, url.String(), bodyReader)
 		if err != nil {
 			return nil, err
 		}
 
+		for key, val := range this.Options.Headers {
+			req.Header.Set(key, val)
+		}
+
+		if this.Options.BearerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+this.Options.BearerToken)
+		}
+
 		for key, values := range headers {
 			for _, val := range values {
 				req.Header.Add(key, val)
@@ -138,29 +334,43 @@ func (this *lokiWriter) fetch(ctx context.Context, method string, url url.URL, h
 		return val >= http.StatusOK && val <= http.StatusIMUsed
 	}
 
-	var doConsumeErrorResponse = func(resp *http.Response) {
+	var doConsumeErrorResponse = func(resp *http.Response) string {
 
 		defer resp.Body.Close()
 
-		switch resp.Header.Get("content-type") {
+		const maxErrorBodySize = 64 * 1024
 
-		case "application/json", "text/plain":
-			if body, err := io.ReadAll(resp.Body); err == nil {
-				slog.Debug("LOKI: API error",
-					slog.Int("status", resp.StatusCode),
-					slog.String("body", string(body)),
-					slog.String("remote", this.baseURL.Host))
-			}
-
-		default:
+		contentType := resp.Header.Get("content-type")
+		if !strings.HasPrefix(contentType, "application/json") && !strings.HasPrefix(contentType, "text/plain") {
 			slog.Debug("LOKI: API error",
 				slog.Int("status", resp.StatusCode),
 				slog.String("remote", this.baseURL.Host))
+			return ""
+		}
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+		if err != nil {
+			return ""
 		}
+
+		slog.Debug("LOKI: API error",
+			slog.Int("status", resp.StatusCode),
+			slog.String("body", string(body)),
+			slog.String("remote", this.baseURL.Host))
+
+		return string(body)
 	}
 
+	started := time.Now()
+
 	var lastErr error
-	for idx := 0; idx < attempts && ctx.Err() == nil; idx++ {
+	for idx := 0; idx < policy.Attempts && ctx.Err() == nil; idx++ {
+
+		if idx > 0 {
+			metricLokiRetries.Inc()
+		}
+
+		var retryAfter time.Duration
 
 		if resp, err := doFetch(); err != nil {
 			slog.Debug("LOKI: API call failed",
@@ -168,39 +378,72 @@ func (this *lokiWriter) fetch(ctx context.Context, method string, url url.URL, h
 			lastErr = fmt.Errorf("http request: %v", err)
 		} else if !isOkayStatusCode(resp.StatusCode) {
 
-			doConsumeErrorResponse(resp)
+			errorBody := doConsumeErrorResponse(resp)
 
 			switch {
 
+			//	retry on rate limiting
+			case resp.StatusCode == http.StatusTooManyRequests:
+				lastErr = fmt.Errorf("rate limited with status '%d'", resp.StatusCode)
+				retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+
 			//	retry on server errors
 			case resp.StatusCode >= http.StatusInternalServerError:
 				lastErr = fmt.Errorf("service down with status '%d'", resp.StatusCode)
+				retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
 
 			//	bail on client errors
 			default:
-				return nil, fmt.Errorf("unexpected status '%d'", resp.StatusCode)
+				return nil, &LokiAPIError{Status: resp.StatusCode, Body: errorBody}
 			}
 
 		} else {
 			return resp, err
 		}
 
-		time.Sleep(attemptDelay)
+		if idx == policy.Attempts-1 {
+			break
+		}
+
+		delay := policy.backoff(idx)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+
+		if policy.MaxElapsed > 0 && time.Since(started)+delay > time.Duration(policy.MaxElapsed) {
+			slog.Debug("LOKI: Retry budget exhausted",
+				slog.Duration("elapsed", time.Since(started)),
+				slog.Int("attempts", idx+1))
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = ctx.Err()
 	}
 
 	return nil, lastErr
 }
 
-func (this *lokiWriter) Ping() error {
+func (this *lokiWriter) Ping(ctx context.Context) error {
+
+	if !this.ready.Load() {
+		return errors.New("waiting for loki to become available")
+	}
+
+	return this.ping(ctx)
+}
 
-	const pingTimeout = 10 * time.Second
+func (this *lokiWriter) ping(ctx context.Context) error {
 
 	pingUrl := this.baseURL
 	pingUrl.Path = "/ready"
 
-	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
-	defer cancel()
-
 	resp, err := this.fetch(ctx, http.MethodGet, pingUrl, nil, nil)
 	if err != nil {
 		return err
@@ -220,71 +463,301 @@ func (this *lokiWriter) WriteEntry(ctx context.Context, entry LogEntry) error {
 
 func (this *lokiWriter) WriteBatch(ctx context.Context, batch []LogEntry) error {
 
+	_, err := this.WriteDeferred(ctx, batch, nil)
+	return err
+}
+
+func (this *lokiWriter) WriteDeferred(ctx context.Context, batch []LogEntry, onWritten func(batch []LogEntry)) (bool, error) {
+
+	if this.enqueue(lokiQueuedBatch{entries: batch, onWritten: onWritten}) {
+		return true, nil
+	}
+
+	return false, this.writeBatch(ctx, batch)
+}
+
+func (this *lokiWriter) writeBatch(ctx context.Context, batch []LogEntry) error {
+
+	tenantBatches := map[string][]LogEntry{}
+	var tenants []string
+
+	for _, entry := range batch {
+
+		tenant := this.entryTenant(entry)
+		if _, has := tenantBatches[tenant]; !has {
+			tenants = append(tenants, tenant)
+		}
+
+		tenantBatches[tenant] = append(tenantBatches[tenant], entry)
+	}
+
+	var errs []error
+
+	for _, tenant := range tenants {
+		if err := this.push(ctx, tenant, tenantBatches[tenant]); err != nil {
+			if tenant != "" {
+				err = fmt.Errorf("tenant '%s': %v", tenant, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Resolves the entry tenant from the stream config only, as any client that can push
+// would otherwise be able to write into other tenants
+func (this *lokiWriter) entryTenant(entry LogEntry) string {
+
+	if this.Options.TenantLabel != "" {
+		if val := entry.StreamLabels[this.Options.TenantLabel]; val != "" {
+			return val
+		}
+	}
+
+	if tenant, has := this.Options.StreamTenants[entry.StreamTag]; has && !isStreamPattern(entry.StreamTag) {
+		return tenant
+	}
+
+	//	the most specific pattern wins, same as with stream keys
+	for _, pattern := range this.tenantPatterns {
+		if _, matched := pattern.match(entry.StreamTag); matched {
+			return pattern.config
+		}
+	}
+
+	return this.Options.Tenant
+}
+
+func (this *lokiWriter) push(ctx context.Context, tenant string, batch []LogEntry) error {
+	return this.pushWithRejections(ctx, tenant, this.groupStreams(tenant, batch))
+}
+
+func (this *lokiWriter) pushStreams(ctx context.Context, tenant string, streams []LokiStream) error {
+
 	pushUrl := this.baseURL
 	pushUrl.Path = "/loki/api/v1/push"
 
-	var streams []LokiStream
+	headers := http.Header{}
+	var body bytes.Buffer
+
+	if tenant != "" {
+		headers.Set("X-Scope-OrgID", tenant)
+	}
+
+	switch this.Format {
+
+	case LokiFormatProtobuf:
+		headers.Set("Content-Type", "application/x-protobuf")
+		body.Write(snappy.Encode(nil, encodeLokiPushRequest(streams)))
+
+	case LokiFormatGzip:
+
+		headers.Set("Content-Type", "application/json")
+		headers.Set("Content-Encoding", "gzip")
+
+		gz := gzip.NewWriter(&body)
+		if err := json.NewEncoder(gz).Encode(map[string]any{
+			"streams": streams,
+		}); err != nil {
+			return fmt.Errorf("json.Marshal: %v", err)
+		}
+
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("gzip: %v", err)
+		}
+
+	default:
+
+		headers.Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(&body).Encode(map[string]any{
+			"streams": streams,
+		}); err != nil {
+			return fmt.Errorf("json.Marshal: %v", err)
+		}
+	}
+
+	resp, err := this.fetch(ctx, http.MethodPost, pushUrl, headers, body.Bytes())
+	if err == nil {
+		defer resp.Body.Close()
+	}
+
+	return err
+}
+
+// Groups entries into loki streams by their label sets
+func (this *lokiWriter) groupStreams(tenant string, batch []LogEntry) []LokiStream {
 
-	for idx, entry := range batch {
+	streamIndex := map[string]*LokiStream{}
+	var streamKeys []string
 
-		stream := map[string]string{}
+	for _, entry := range batch {
+
+		labels, structMeta := this.entryLabels(entry)
 
 		streamVal := LokiStreamValue{
-			Sequence:  int64(idx),
-			Timestamp: entry.Timestamp,
-			LogLine:   entry.Message,
+			Timestamp:          entry.Timestamp,
+			LogLine:            entry.Message,
+			StructuredMetadata: structMeta,
+			entry:              entry,
 		}
 
-		if !this.UseStructMeta {
+		key := lokiSequenceKey(tenant, labels)
 
-			for key, val := range entry.Metadata {
-				stream[key] = val
-			}
+		stream, has := streamIndex[key]
+		if !has {
+			stream = &LokiStream{Stream: labels}
+			streamIndex[key] = stream
+			streamKeys = append(streamKeys, key)
+		}
 
-		} else {
+		stream.Values = append(stream.Values, streamVal)
+	}
+
+	sort.Strings(streamKeys)
 
-			streamVal.StructuredMetadata = map[string]string{}
+	this.sequenceMtx.Lock()
+	defer this.sequenceMtx.Unlock()
 
-			for key, val := range entry.Metadata {
+	if this.sequenceCursors == nil {
+		this.sequenceCursors = map[string]int64{}
+	}
+
+	streams := make([]LokiStream, 0, len(streamKeys))
+
+	for _, key := range streamKeys {
+		stream := streamIndex[key]
+		this.sequenceStream(key, stream.Values)
+		streams = append(streams, *stream)
+	}
+
+	this.pruneSequenceCursors()
+
+	return streams
+}
 
-				if transform, isLabel := this.ExtractLabels[key]; isLabel {
+func (this *lokiWriter) entryLabels(entry LogEntry) (map[string]string, map[string]string) {
 
-					if transform != nil {
-						key, val = transform(val)
-					}
+	labels := map[string]string{}
+	var structMeta map[string]string
 
-					stream[key] = val
-					continue
+	if !this.UseStructMeta {
+
+		for key, val := range entry.Metadata {
+			labels[key] = val
+		}
+
+	} else {
+
+		structMeta = map[string]string{}
+
+		for key, val := range entry.Metadata {
+
+			if transform, isLabel := this.ExtractLabels[key]; isLabel {
+
+				if transform != nil {
+					key, val = transform(val)
 				}
 
-				streamVal.StructuredMetadata[key] = val
+				labels[key] = val
+				continue
 			}
+
+			structMeta[key] = val
 		}
+	}
+
+	if this.cardinality != nil {
+		structMeta = this.cardinality.apply(labels, structMeta)
+	}
 
-		if entry.StreamTag != "" {
-			stream["service_name"] = entry.StreamTag
+	for key, val := range this.Options.Labels.Defaults {
+		if labels[key] == "" {
+			labels[key] = val
 		}
+	}
 
-		stream["level"] = entry.LogLevel.String()
-		stream["mws_source"] = "logpush"
+	if entry.StreamTag != "" {
+		labels["service_name"] = entry.StreamTag
+	}
 
-		streams = append(streams, LokiStream{Stream: stream, Values: []LokiStreamValue{streamVal}})
+	if this.Options.RetentionLabel != "" && entry.Retention > 0 {
+		labels[this.Options.RetentionLabel] = Duration(entry.Retention).String()
 	}
 
-	var body bytes.Buffer
-	if err := json.NewEncoder(&body).Encode(map[string]any{
-		"streams": streams,
-	}); err != nil {
-		return fmt.Errorf("json.Marshal: %v", err)
+	labels["level"] = entry.LogLevel.String()
+	labels["mws_source"] = "logpush"
+
+	return labels, structMeta
+}
+
+// Sorts stream values by time and shifts entries with identical timestamps by a nanosecond
+// so that loki doesn't consider them duplicates. The last used timestamp is kept per stream
+// which keeps the ordering stable across batches.
+// Must be called with sequenceMtx locked
+func (this *lokiWriter) sequenceStream(key string, values []LokiStreamValue) {
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Timestamp.Before(values[j].Timestamp)
+	})
+
+	last, hasLast := this.sequenceCursors[key]
+
+	for idx := range values {
+
+		ts := values[idx].Timestamp.UnixNano()
+
+		//	only shift entries that collide with the previous one within the same millisecond,
+		//	anything older than that is a genuinely out of order entry and must stay as is
+		if hasLast && ts <= last && last-ts < int64(time.Millisecond) {
+			values[idx].Sequence = last + 1 - ts
+			ts = last + 1
+		}
+
+		if !hasLast || ts > last {
+			last = ts
+			hasLast = true
+		}
 	}
 
-	headers := http.Header{}
-	headers.Set("Content-Type", "application/json")
+	this.sequenceCursors[key] = last
+}
 
-	resp, err := this.fetch(ctx, http.MethodPost, pushUrl, headers, &body)
-	if err == nil {
-		defer resp.Body.Close()
+func (this *lokiWriter) pruneSequenceCursors() {
+
+	const cursorTTL = 10 * time.Minute
+
+	expireBefore := time.Now().Add(-cursorTTL).UnixNano()
+
+	for key, val := range this.sequenceCursors {
+		if val < expireBefore {
+			delete(this.sequenceCursors, key)
+		}
 	}
+}
 
-	return err
+// Identifies a stream for sequencing; the same label set in different tenants is a different stream
+func lokiSequenceKey(tenant string, labels map[string]string) string {
+	return tenant + "/" + lokiLabelsKey(labels)
+}
+
+func lokiLabelsKey(labels map[string]string) string {
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	for _, key := range keys {
+		builder.WriteString(strconv.Quote(key))
+		builder.WriteByte('=')
+		builder.WriteString(strconv.Quote(labels[key]))
+		builder.WriteByte(',')
+	}
+
+	return builder.String()
 }
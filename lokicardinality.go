@@ -0,0 +1,134 @@
+package logpush
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type LokiCardinalityOptions struct {
+	//	Max distinct values a label can have within the window. The guard is disabled when not set
+	Limit int `yaml:"limit" json:"limit"`
+	//	Sliding window for counting distinct values. Defaults to 10 minutes
+	Window Duration `yaml:"window" json:"window"`
+	//	What to do with a label over the limit: demote (to structured metadata) or drop. Defaults to demote
+	Action string `yaml:"action" json:"action"`
+}
+
+const (
+	lokiCardinalityDemote = "demote"
+	lokiCardinalityDrop   = "drop"
+)
+
+func newLokiCardinalityGuard(opts LokiCardinalityOptions) *lokiCardinalityGuard {
+
+	if opts.Limit <= 0 {
+		return nil
+	}
+
+	if opts.Window <= 0 {
+		opts.Window = Duration(10 * time.Minute)
+	}
+
+	if opts.Action != lokiCardinalityDrop {
+		opts.Action = lokiCardinalityDemote
+	}
+
+	return &lokiCardinalityGuard{
+		limit:   opts.Limit,
+		window:  time.Duration(opts.Window),
+		action:  opts.Action,
+		values:  map[string]map[string]time.Time{},
+		tripped: map[string]time.Time{},
+	}
+}
+
+// Tracks distinct label values and stops labels from exploding stream cardinality
+type lokiCardinalityGuard struct {
+	limit  int
+	window time.Duration
+	action string
+
+	mtx     sync.Mutex
+	values  map[string]map[string]time.Time
+	tripped map[string]time.Time
+}
+
+// Checks if a label value can be used as a stream label
+func (this *lokiCardinalityGuard) admit(key string, val string, now time.Time) bool {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if until, has := this.tripped[key]; has {
+
+		if now.Before(until) {
+			return false
+		}
+
+		delete(this.tripped, key)
+		delete(this.values, key)
+	}
+
+	seen := this.values[key]
+	if seen == nil {
+		seen = map[string]time.Time{}
+		this.values[key] = seen
+	}
+
+	if _, has := seen[val]; has || len(seen) < this.limit {
+		seen[val] = now
+		return true
+	}
+
+	expireBefore := now.Add(-this.window)
+	for seenVal, lastSeen := range seen {
+		if lastSeen.Before(expireBefore) {
+			delete(seen, seenVal)
+		}
+	}
+
+	if len(seen) < this.limit {
+		seen[val] = now
+		return true
+	}
+
+	//	keep the label limited for a whole window so that it doesn't flap
+	this.tripped[key] = now.Add(this.window)
+	delete(this.values, key)
+
+	slog.Warn("LOKI: Label cardinality limit reached",
+		slog.String("label", key),
+		slog.Int("limit", this.limit),
+		slog.String("action", this.action),
+		slog.Duration("for", this.window))
+
+	//	label keys come from client metadata, so they aren't used as metric labels
+	metricLokiCardinalityTrips.WithLabelValues(this.action).Inc()
+
+	return false
+}
+
+// Applies the guard to entry labels, moving or removing the ones over the limit
+func (this *lokiCardinalityGuard) apply(labels map[string]string, structMeta map[string]string) map[string]string {
+
+	now := time.Now()
+
+	for key, val := range labels {
+
+		if this.admit(key, val, now) {
+			continue
+		}
+
+		delete(labels, key)
+
+		if this.action == lokiCardinalityDemote {
+			if structMeta == nil {
+				structMeta = map[string]string{}
+			}
+			structMeta[key] = val
+		}
+	}
+
+	return structMeta
+}
@@ -0,0 +1,112 @@
+package logpush
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type LokiLabelOptions struct {
+	//	Metadata keys promoted to index labels when structured metadata is enabled.
+	//	Replaces the built-in set when not empty
+	Promote []string `yaml:"promote" json:"promote"`
+	//	Renames metadata keys before promoting them, i.e. "environment: env".
+	//	Replaces the built-in renames when not empty
+	Rename map[string]string `yaml:"rename" json:"rename"`
+	//	Value normalization rules for promoted labels, applied in order
+	Normalize []LokiLabelRule `yaml:"normalize" json:"normalize"`
+	//	Values set for labels that are missing from an entry
+	Defaults map[string]string `yaml:"defaults" json:"defaults"`
+}
+
+type LokiLabelRule struct {
+	//	Label (after renaming) that this rule applies to. Applies to all promoted labels when empty
+	Label string `yaml:"label" json:"label"`
+	//	Convert the value to lower case
+	Lowercase bool `yaml:"lowercase" json:"lowercase"`
+	//	Regular expression to replace in the value
+	Match string `yaml:"match" json:"match"`
+	//	Replacement for the matched expression. Supports capture groups like $1
+	Replace string `yaml:"replace" json:"replace"`
+
+	expr *regexp.Regexp
+}
+
+var lokiDefaultPromotedLabels = []string{"level", "ip", "rid", "org", "app", "env", "service", "scope"}
+
+var lokiDefaultLabelRenames = map[string]string{
+	"remote_addr": "ip",
+	"client_ip":   "ip",
+	"request_id":  "rid",
+	"environment": "env",
+}
+
+// Builds the label extraction map from label options
+func (this LokiLabelOptions) Transformers() (map[string]LokiLabelTransformer, error) {
+
+	promote := this.Promote
+	if len(promote) == 0 {
+		promote = lokiDefaultPromotedLabels
+	}
+
+	renames := this.Rename
+	if len(renames) == 0 {
+		renames = lokiDefaultLabelRenames
+	}
+
+	rules := make([]LokiLabelRule, len(this.Normalize))
+	for idx, rule := range this.Normalize {
+
+		if rule.Match != "" {
+			expr, err := regexp.Compile(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("label rule %d: invalid expression: %v", idx, err)
+			}
+			rule.expr = expr
+		}
+
+		rules[idx] = rule
+	}
+
+	var newTransformer = func(key string) LokiLabelTransformer {
+
+		var keyRules []LokiLabelRule
+		for _, rule := range rules {
+			if rule.Label == "" || rule.Label == key {
+				keyRules = append(keyRules, rule)
+			}
+		}
+
+		return func(val string) (string, string) {
+
+			for _, rule := range keyRules {
+
+				if rule.Lowercase {
+					val = strings.ToLower(val)
+				}
+
+				if rule.expr != nil {
+					val = rule.expr.ReplaceAllString(val, rule.Replace)
+				}
+			}
+
+			return key, val
+		}
+	}
+
+	promoted := map[string]bool{}
+	transformers := map[string]LokiLabelTransformer{}
+
+	for _, key := range promote {
+		promoted[key] = true
+		transformers[key] = newTransformer(key)
+	}
+
+	for from, to := range renames {
+		if promoted[to] {
+			transformers[from] = newTransformer(to)
+		}
+	}
+
+	return transformers, nil
+}
@@ -0,0 +1,136 @@
+package logpush
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A minimal hand-written encoder for loki's logproto.PushRequest.
+// Pulling the whole loki module in just for these three messages isn't worth it,
+// so the tests check the output against loki's own push types instead.
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { Timestamp timestamp = 1; string line = 2; repeated LabelPairAdapter structuredMetadata = 3; }
+//	message LabelPairAdapter { string name = 1; string value = 2; }
+//	message Timestamp { int64 seconds = 1; int32 nanos = 2; }
+
+const (
+	protoWireVarint = 0
+	protoWireBytes  = 2
+)
+
+func protoAppendTag(buf []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(field<<3|wireType))
+}
+
+func protoAppendVarint(buf []byte, field int, val uint64) []byte {
+	if val == 0 {
+		return buf
+	}
+	buf = protoAppendTag(buf, field, protoWireVarint)
+	return binary.AppendUvarint(buf, val)
+}
+
+func protoAppendBytes(buf []byte, field int, val []byte) []byte {
+	buf = protoAppendTag(buf, field, protoWireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(val)))
+	return append(buf, val...)
+}
+
+func protoAppendString(buf []byte, field int, val string) []byte {
+	if val == "" {
+		return buf
+	}
+	buf = protoAppendTag(buf, field, protoWireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(val)))
+	return append(buf, val...)
+}
+
+func encodeLokiPushRequest(streams []LokiStream) []byte {
+
+	var buf []byte
+	for _, stream := range streams {
+		buf = protoAppendBytes(buf, 1, encodeLokiStreamAdapter(stream))
+	}
+
+	return buf
+}
+
+func encodeLokiStreamAdapter(stream LokiStream) []byte {
+
+	buf := protoAppendString(nil, 1, formatLokiLabels(stream.Stream))
+
+	for _, val := range stream.Values {
+		buf = protoAppendBytes(buf, 2, encodeLokiEntryAdapter(val))
+	}
+
+	return buf
+}
+
+func encodeLokiEntryAdapter(entry LokiStreamValue) []byte {
+
+	ts := entry.Timestamp.UnixNano() + entry.Sequence
+
+	seconds, nanos := ts/1e9, ts%1e9
+	if nanos < 0 {
+		seconds--
+		nanos += 1e9
+	}
+
+	var timestamp []byte
+	timestamp = protoAppendVarint(timestamp, 1, uint64(seconds))
+	timestamp = protoAppendVarint(timestamp, 2, uint64(nanos))
+
+	buf := protoAppendBytes(nil, 1, timestamp)
+	buf = protoAppendString(buf, 2, entry.LogLine)
+
+	keys := make([]string, 0, len(entry.StructuredMetadata))
+	for key := range entry.StructuredMetadata {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+
+		var pair []byte
+		pair = protoAppendString(pair, 1, key)
+		pair = protoAppendString(pair, 2, entry.StructuredMetadata[key])
+
+		buf = protoAppendBytes(buf, 3, pair)
+	}
+
+	return buf
+}
+
+// Formats labels the way prometheus does: {key="value", key2="value2"}
+func formatLokiLabels(labels map[string]string) string {
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var builder strings.Builder
+	builder.WriteByte('{')
+
+	for idx, key := range keys {
+
+		if idx > 0 {
+			builder.WriteString(", ")
+		}
+
+		builder.WriteString(key)
+		builder.WriteByte('=')
+		builder.WriteString(strconv.Quote(labels[key]))
+	}
+
+	builder.WriteByte('}')
+
+	return builder.String()
+}
@@ -0,0 +1,85 @@
+package logpush
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/pkg/push"
+)
+
+func TestEncodeLokiPushRequest(t *testing.T) {
+
+	ts := time.Date(2024, 5, 14, 11, 28, 48, 999_999_999, time.UTC)
+
+	streams := []LokiStream{
+		{
+			Stream: map[string]string{"service_name": "web", "level": "info", "quoted": "say \"hi\"\n"},
+			Values: []LokiStreamValue{
+				{Timestamp: ts, LogLine: "first"},
+				//	the sequence offset has to carry over into the next second
+				{Timestamp: ts, Sequence: 1, LogLine: "second ✓", StructuredMetadata: map[string]string{"rid": "abc", "empty": "", "ip": "10.0.0.1"}},
+			},
+		},
+		{
+			Stream: map[string]string{},
+			Values: []LokiStreamValue{
+				{Timestamp: time.Unix(0, 0), LogLine: ""},
+			},
+		},
+	}
+
+	//	loki receives the payload snappy-compressed
+	payload, err := snappy.Decode(nil, snappy.Encode(nil, encodeLokiPushRequest(streams)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var req push.PushRequest
+	if err := req.Unmarshal(payload); err != nil {
+		t.Fatalf("loki can't decode the payload: %v", err)
+	}
+
+	if len(req.Streams) != len(streams) {
+		t.Fatalf("expected %d streams, got %d", len(streams), len(req.Streams))
+	}
+
+	if want := `{level="info", quoted="say \"hi\"\n", service_name="web"}`; req.Streams[0].Labels != want {
+		t.Errorf("labels: expected %s, got %s", want, req.Streams[0].Labels)
+	}
+
+	if want := `{}`; req.Streams[1].Labels != want {
+		t.Errorf("labels: expected %s, got %s", want, req.Streams[1].Labels)
+	}
+
+	for idx, stream := range streams {
+
+		entries := req.Streams[idx].Entries
+		if len(entries) != len(stream.Values) {
+			t.Fatalf("stream %d: expected %d entries, got %d", idx, len(stream.Values), len(entries))
+		}
+
+		for entryIdx, val := range stream.Values {
+
+			entry := entries[entryIdx]
+
+			if want := val.Timestamp.Add(time.Duration(val.Sequence)); !entry.Timestamp.Equal(want) {
+				t.Errorf("stream %d entry %d: expected timestamp %v, got %v", idx, entryIdx, want, entry.Timestamp)
+			}
+
+			if entry.Line != val.LogLine {
+				t.Errorf("stream %d entry %d: expected line %q, got %q", idx, entryIdx, val.LogLine, entry.Line)
+			}
+
+			if len(entry.StructuredMetadata) != len(val.StructuredMetadata) {
+				t.Fatalf("stream %d entry %d: expected %d metadata fields, got %d", idx, entryIdx, len(val.StructuredMetadata), len(entry.StructuredMetadata))
+			}
+
+			for _, pair := range entry.StructuredMetadata {
+				if want, has := val.StructuredMetadata[pair.Name]; !has || want != pair.Value {
+					t.Errorf("stream %d entry %d: unexpected metadata field %s=%q", idx, entryIdx, pair.Name, pair.Value)
+				}
+			}
+		}
+	}
+}
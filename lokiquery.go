@@ -0,0 +1,296 @@
+package logpush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Loki's default max_entries_limit_per_query
+const lokiDefaultMaxQueryEntries = 5000
+
+var lokiExprLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Translates a query filter into LogQL
+func (this *lokiWriter) buildLogQL(query LogQuery) (string, error) {
+
+	var matchers []string
+
+	if prefix, suffix, isPattern := strings.Cut(query.Tag, streamWildcard); isPattern {
+		matchers = append(matchers, "service_name=~"+strconv.Quote(regexp.QuoteMeta(prefix)+".+"+regexp.QuoteMeta(suffix)))
+	} else if query.Tag != "" {
+		matchers = append(matchers, "service_name="+strconv.Quote(query.Tag))
+	} else {
+		//	loki requires at least one non-empty matcher
+		matchers = append(matchers, `mws_source="logpush"`)
+	}
+
+	if len(query.Levels) > 0 {
+
+		var levels []string
+		for _, val := range query.Levels {
+			levels = append(levels, regexp.QuoteMeta(val))
+		}
+
+		matchers = append(matchers, "level=~"+strconv.Quote(strings.Join(levels, "|")))
+	}
+
+	logql := "{" + strings.Join(matchers, ", ") + "}"
+
+	if query.Contains != "" {
+		logql += " |= " + strconv.Quote(query.Contains)
+	}
+
+	//	label filters match both index labels and structured metadata
+	metaKeys := make([]string, 0, len(query.Meta))
+	for key := range query.Meta {
+		metaKeys = append(metaKeys, key)
+	}
+	sort.Strings(metaKeys)
+
+	for _, key := range metaKeys {
+
+		label, val := this.filterLabel(key, query.Meta[key])
+
+		if !lokiExprLabelName.MatchString(label) {
+			return "", fmt.Errorf("%w: '%s' is not a valid loki label name", ErrInvalidQuery, label)
+		}
+
+		logql += fmt.Sprintf(" | %s=%s", label, strconv.Quote(val))
+	}
+
+	return logql, nil
+}
+
+// Applies the same rename and normalization rules to a metadata filter that entryLabels applies on push
+func (this *lokiWriter) filterLabel(key string, val string) (string, string) {
+
+	if !this.UseStructMeta {
+		return key, val
+	}
+
+	if transform := this.ExtractLabels[key]; transform != nil {
+		return transform(val)
+	}
+
+	return key, val
+}
+
+// Lists the tenants that may have entries matching the query
+func (this *lokiWriter) queryTenants(query LogQuery) ([]string, error) {
+
+	//	tenants come from stream labels that can only be told apart by the label itself
+	if this.Options.TenantLabel != "" {
+
+		if val := query.Meta[this.Options.TenantLabel]; val != "" {
+			return []string{val}, nil
+		}
+
+		return nil, fmt.Errorf("%w: 'meta.%s' is required to pick a loki tenant", ErrInvalidQuery, this.Options.TenantLabel)
+	}
+
+	if query.Tag != "" && !isStreamPattern(query.Tag) {
+		return []string{this.entryTenant(LogEntry{StreamTag: query.Tag})}, nil
+	}
+
+	//	wildcard and empty tags can match streams of any tenant
+	tenants := []string{this.Options.Tenant}
+	seen := map[string]bool{this.Options.Tenant: true}
+
+	for _, pattern := range this.tenantPatterns {
+		if !seen[pattern.config] {
+			seen[pattern.config] = true
+			tenants = append(tenants, pattern.config)
+		}
+	}
+
+	var exact []string
+	for key, tenant := range this.Options.StreamTenants {
+		if !isStreamPattern(key) && !seen[tenant] {
+			seen[tenant] = true
+			exact = append(exact, tenant)
+		}
+	}
+
+	sort.Strings(exact)
+
+	return append(tenants, exact...), nil
+}
+
+type lokiQueryResponse struct {
+	Data struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Stream map[string]string   `json:"stream"`
+			Values [][]json.RawMessage `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// Searches loki with query_range. Without a start time, loki's default range of the last hour is used.
+// Queries that may match streams of multiple tenants are sent to each of them
+func (this *lokiWriter) Query(ctx context.Context, query LogQuery) (*LogQueryResult, error) {
+
+	cursor, err := parseQueryCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = queryDefaultLimit
+	}
+
+	maxEntries := this.Options.MaxQueryEntries
+	if maxEntries <= 0 {
+		maxEntries = lokiDefaultMaxQueryEntries
+	}
+
+	logql, err := this.buildLogQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := this.queryTenants(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var skip int
+
+	params := url.Values{
+		"query":     {logql},
+		"direction": {"backward"},
+	}
+
+	if !query.From.IsZero() {
+		params.Set("start", strconv.FormatInt(query.From.UnixNano(), 10))
+	}
+
+	end := query.To
+	if cursor != nil {
+
+		//	entries sharing the cursor timestamp are fetched again and skipped
+		if cursor.Skip >= maxEntries {
+			return nil, fmt.Errorf("%w: over %d entries share the same timestamp, which is more than loki returns per query", ErrInvalidQuery, maxEntries)
+		}
+
+		skip = cursor.Skip
+
+		if cursorEnd := cursor.Time.Add(time.Nanosecond); end.IsZero() || cursorEnd.Before(end) {
+			end = cursorEnd
+		}
+	}
+
+	//	loki rejects queries over its max_entries_limit_per_query
+	if query.Limit+skip > maxEntries {
+		query.Limit = maxEntries - skip
+	}
+
+	params.Set("limit", strconv.Itoa(query.Limit+skip))
+
+	if !end.IsZero() {
+		params.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	}
+
+	var entries []LogEntry
+
+	for _, tenant := range tenants {
+
+		tenantEntries, err := this.queryTenant(ctx, tenant, params)
+		if err != nil {
+			if len(tenants) > 1 && tenant != "" {
+				err = fmt.Errorf("tenant '%s': %w", tenant, err)
+			}
+			return nil, err
+		}
+
+		entries = append(entries, tenantEntries...)
+	}
+
+	return pageQueryEntries(entries, query)
+}
+
+func (this *lokiWriter) queryTenant(ctx context.Context, tenant string, params url.Values) ([]LogEntry, error) {
+
+	queryUrl := this.baseURL
+	queryUrl.Path = "/loki/api/v1/query_range"
+	queryUrl.RawQuery = params.Encode()
+
+	headers := http.Header{}
+	if tenant != "" {
+		headers.Set("X-Scope-OrgID", tenant)
+	}
+
+	resp, err := this.fetch(ctx, http.MethodGet, queryUrl, headers, nil)
+	if apiErr := (*LokiAPIError)(nil); errors.As(err, &apiErr) && apiErr.Status == http.StatusBadRequest {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidQuery, strings.TrimSpace(apiErr.Body))
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var payload lokiQueryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return nil, fmt.Errorf("failed to decode query response: %v", err)
+	}
+
+	if payload.Data.ResultType != "streams" {
+		return nil, fmt.Errorf("unexpected result type '%s'", payload.Data.ResultType)
+	}
+
+	var entries []LogEntry
+
+	for _, stream := range payload.Data.Result {
+
+		meta := map[string]string{}
+		for key, val := range stream.Stream {
+			switch key {
+			case "service_name", "level", "mws_source":
+			default:
+				meta[key] = val
+			}
+		}
+
+		for _, val := range stream.Values {
+
+			if len(val) < 2 {
+				continue
+			}
+
+			var tsVal, line string
+			if err := json.Unmarshal(val[0], &tsVal); err != nil {
+				continue
+			} else if err := json.Unmarshal(val[1], &line); err != nil {
+				continue
+			}
+
+			ts, err := strconv.ParseInt(tsVal, 10, 64)
+			if err != nil {
+				continue
+			}
+
+			entry := LogEntry{
+				Timestamp: time.Unix(0, ts).UTC(),
+				StreamTag: stream.Stream["service_name"],
+				LogLevel:  LogLevel(stream.Stream["level"]),
+				Message:   line,
+			}
+
+			if len(meta) > 0 {
+				entry.Metadata = meta
+			}
+
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
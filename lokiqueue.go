@@ -0,0 +1,148 @@
+package logpush
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+func (this *lokiWriter) startProbing() {
+
+	interval := time.Duration(this.Options.ProbeInterval)
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	this.probeCancel = cancel
+
+	slog.Warn("LOKI: Starting without a connection, writes will be queued until loki is available",
+		slog.String("remote", this.baseURL.Host))
+
+	go func() {
+
+		for ctx.Err() == nil {
+
+			pingCtx, cancelPing := context.WithTimeout(ctx, interval)
+			err := this.ping(pingCtx)
+			cancelPing()
+
+			if err == nil {
+				this.flushQueue(ctx)
+				return
+			}
+
+			slog.Debug("LOKI: Still unavailable",
+				slog.String("remote", this.baseURL.Host),
+				slog.String("err", err.Error()))
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+type lokiQueuedBatch struct {
+	entries   []LogEntry
+	onWritten func(batch []LogEntry)
+}
+
+// Queues a batch if loki isn't available yet. Returns false when the batch should be written right away
+func (this *lokiWriter) enqueue(batch lokiQueuedBatch) bool {
+
+	if this.ready.Load() {
+		return false
+	}
+
+	this.queueMtx.Lock()
+	defer this.queueMtx.Unlock()
+
+	//	could've become ready while waiting for the lock
+	if this.ready.Load() {
+		return false
+	}
+
+	queueSize := this.Options.QueueSize
+	if queueSize <= 0 {
+		queueSize = 100_000
+	}
+
+	this.queue = append(this.queue, batch)
+	this.queueDepth += len(batch.entries)
+
+	//	drop the oldest batches to make room for the new ones
+	var dropped int
+	for this.queueDepth > queueSize && len(this.queue) > 1 {
+		dropped += len(this.queue[0].entries)
+		this.queueDepth -= len(this.queue[0].entries)
+		this.queue = this.queue[1:]
+	}
+
+	if dropped > 0 {
+		slog.Warn("LOKI: Queue full, dropped oldest entries",
+			slog.Int("dropped", dropped),
+			slog.Int("queue_size", queueSize))
+		metricWriterErrors.WithLabelValues(this.Type()).Inc()
+	}
+
+	return true
+}
+
+// Writes out queued batches in order. New writes keep going into the queue until it's empty,
+// otherwise they would reach loki ahead of older queued entries and get rejected as out of order
+func (this *lokiWriter) flushQueue(ctx context.Context) {
+
+	slog.Info("LOKI: Connected",
+		slog.String("remote", this.baseURL.Host),
+		slog.Int("queued_entries", this.QueueDepth()))
+
+	for ctx.Err() == nil {
+
+		this.queueMtx.Lock()
+
+		if len(this.queue) == 0 {
+			this.ready.Store(true)
+			this.queueMtx.Unlock()
+			return
+		}
+
+		batch := this.queue[0]
+		this.queue = this.queue[1:]
+		this.queueDepth -= len(batch.entries)
+
+		this.queueMtx.Unlock()
+
+		if err := this.writeBatch(ctx, batch.entries); err != nil {
+			metricWriterErrors.WithLabelValues(this.Type()).Inc()
+			slog.Error("LOKI: Failed to write queued batch",
+				slog.Int("entries", len(batch.entries)),
+				slog.String("err", err.Error()))
+			continue
+		}
+
+		if batch.onWritten != nil {
+			batch.onWritten(batch.entries)
+		}
+	}
+}
+
+func (this *lokiWriter) QueueDepth() int {
+	this.queueMtx.Lock()
+	defer this.queueMtx.Unlock()
+	return this.queueDepth
+}
+
+func (this *lokiWriter) Close() error {
+
+	if this.probeCancel != nil {
+		this.probeCancel()
+	}
+
+	if closer, ok := this.deadLetter.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
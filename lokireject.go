@@ -0,0 +1,277 @@
+package logpush
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type LokiRejectOptions struct {
+	//	What to do with entries that loki rejects for being too old or out of order:
+	//	drop, clamp (resend with the current time and the original one in "original_ts" structured metadata)
+	//	or dead_letter (write to a file). Defaults to drop
+	Action string `yaml:"action" json:"action"`
+	//	Newline-delimited json file for the dead_letter action
+	DeadLetterFile string `yaml:"dead_letter_file" json:"dead_letter_file"`
+}
+
+const (
+	lokiRejectDrop       = "drop"
+	lokiRejectClamp      = "clamp"
+	lokiRejectDeadLetter = "dead_letter"
+)
+
+// LokiAPIError is returned when loki responds with a non-retryable status code
+type LokiAPIError struct {
+	Status int
+	Body   string
+}
+
+func (this *LokiAPIError) Error() string {
+	return fmt.Sprintf("unexpected status '%d'", this.Status)
+}
+
+// A single entry rejection parsed from a loki error response
+type lokiRejection struct {
+	labels    string
+	timestamp time.Time
+	//	timestamp only has a second precision
+	coarse bool
+}
+
+func (this lokiRejection) matches(labels string, ts time.Time) bool {
+
+	if this.labels != "" && this.labels != labels {
+		return false
+	}
+
+	if this.coarse {
+		return this.timestamp.Unix() == ts.Unix()
+	}
+
+	return this.timestamp.Equal(ts)
+}
+
+var (
+	//	distributor validation errors:
+	//	entry for stream '{app="foo"}' has timestamp too old: 2021-01-01T00:00:00Z, oldest acceptable timestamp is: 2024-01-01T00:00:00Z
+	lokiExprTooOld = regexp.MustCompile(`entry for stream '(\{.*?\})' has timestamp too (?:old|new): ([0-9TZ:+\-]+)`)
+	//	ingester errors:
+	//	entry with timestamp 2024-01-01 00:00:00.123 +0000 UTC ignored, reason: 'entry out of order',
+	lokiExprIgnored = regexp.MustCompile(`entry with timestamp (.+?) ignored, reason: '(.*?)'`)
+	//	user 'fake', total ignored: 1 out of 2 for stream: {app="foo"}
+	lokiExprIgnoredStream = regexp.MustCompile(`for stream: (\{.*\})`)
+)
+
+func isLokiRejectionReason(reason string) bool {
+	return strings.Contains(reason, "out of order") ||
+		strings.Contains(reason, "too far behind") ||
+		strings.Contains(reason, "too old") ||
+		strings.Contains(reason, "too new")
+}
+
+// Parses loki's push error response. Returns false if the error isn't caused by timestamp rejections
+func parseLokiRejections(body string) ([]lokiRejection, bool) {
+
+	if !isLokiRejectionReason(body) {
+		return nil, false
+	}
+
+	var rejections []lokiRejection
+	var pending []lokiRejection
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+
+		line := scanner.Text()
+
+		for _, match := range lokiExprTooOld.FindAllStringSubmatch(line, -1) {
+			if ts, err := time.Parse(time.RFC3339, match[2]); err == nil {
+				rejections = append(rejections, lokiRejection{labels: match[1], timestamp: ts, coarse: true})
+			}
+		}
+
+		if match := lokiExprIgnored.FindStringSubmatch(line); match != nil && isLokiRejectionReason(match[2]) {
+			if ts, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", match[1]); err == nil {
+				pending = append(pending, lokiRejection{timestamp: ts})
+			}
+		}
+
+		//	ingester reports the stream after listing all the entries
+		if match := lokiExprIgnoredStream.FindStringSubmatch(line); match != nil {
+			for _, val := range pending {
+				val.labels = match[1]
+				rejections = append(rejections, val)
+			}
+			pending = nil
+		}
+	}
+
+	return append(rejections, pending...), true
+}
+
+// Splits streams into the values that were accepted and those that were rejected by loki
+func splitLokiRejected(streams []LokiStream, rejections []lokiRejection) ([]LokiStream, []LokiStream) {
+
+	var accepted []LokiStream
+	var rejected []LokiStream
+
+	for _, stream := range streams {
+
+		labels := formatLokiLabels(stream.Stream)
+
+		var acceptedValues []LokiStreamValue
+		var rejectedValues []LokiStreamValue
+
+		for _, val := range stream.Values {
+
+			ts := val.Timestamp.Add(time.Duration(val.Sequence))
+
+			var isRejected bool
+			for _, rejection := range rejections {
+				if rejection.matches(labels, ts) {
+					isRejected = true
+					break
+				}
+			}
+
+			if isRejected {
+				rejectedValues = append(rejectedValues, val)
+			} else {
+				acceptedValues = append(acceptedValues, val)
+			}
+		}
+
+		if len(acceptedValues) > 0 {
+			accepted = append(accepted, LokiStream{Stream: stream.Stream, Values: acceptedValues})
+		}
+
+		if len(rejectedValues) > 0 {
+			rejected = append(rejected, LokiStream{Stream: stream.Stream, Values: rejectedValues})
+		}
+	}
+
+	return accepted, rejected
+}
+
+// Pushes streams splitting out entries that loki rejects due to their timestamps
+func (this *lokiWriter) pushWithRejections(ctx context.Context, tenant string, streams []LokiStream) error {
+
+	//	loki doesn't always list every rejected entry, so it may take a few rounds to get the rest of them
+	const maxRounds = 5
+
+	for round := 0; len(streams) > 0; round++ {
+
+		err := this.pushStreams(ctx, tenant, streams)
+
+		var apiErr *LokiAPIError
+		if !errors.As(err, &apiErr) || apiErr.Status != 400 {
+			return err
+		}
+
+		//	entries that couldn't be identified fail the batch like any other error,
+		//	as handling the whole batch as rejected would drop or rewrite perfectly fine entries
+		if round == maxRounds-1 {
+			return err
+		}
+
+		rejections, isRejection := parseLokiRejections(apiErr.Body)
+		if !isRejection {
+			return err
+		}
+
+		accepted, rejected := splitLokiRejected(streams, rejections)
+		if len(rejected) == 0 {
+			return err
+		}
+
+		if err := this.handleRejected(ctx, tenant, rejected); err != nil {
+			return err
+		}
+
+		streams = accepted
+	}
+
+	return nil
+}
+
+func (this *lokiWriter) handleRejected(ctx context.Context, tenant string, streams []LokiStream) error {
+
+	var count int
+	for _, stream := range streams {
+		count += len(stream.Values)
+	}
+
+	action := this.Options.Reject.Action
+	if action == "" {
+		action = lokiRejectDrop
+	}
+
+	slog.Warn("LOKI: Entries rejected due to their timestamps",
+		slog.Int("entries", count),
+		slog.String("tenant", tenant),
+		slog.String("action", action))
+
+	metricLokiRejectedEntries.WithLabelValues(action).Add(float64(count))
+
+	switch action {
+
+	case lokiRejectClamp:
+
+		now := time.Now()
+
+		this.sequenceMtx.Lock()
+
+		if this.sequenceCursors == nil {
+			this.sequenceCursors = map[string]int64{}
+		}
+
+		for _, stream := range streams {
+
+			for idx := range stream.Values {
+
+				val := &stream.Values[idx]
+
+				meta := map[string]string{}
+				for key, metaVal := range val.StructuredMetadata {
+					meta[key] = metaVal
+				}
+
+				meta["original_ts"] = val.Timestamp.Add(time.Duration(val.Sequence)).Format(time.RFC3339Nano)
+
+				val.StructuredMetadata = meta
+				val.Timestamp = now
+				val.Sequence = 0
+			}
+
+			//	clamped entries continue the stream's sequence so that they don't collide with the ones already sent
+			this.sequenceStream(lokiSequenceKey(tenant, stream.Stream), stream.Values)
+		}
+
+		this.sequenceMtx.Unlock()
+
+		return this.pushStreams(ctx, tenant, streams)
+
+	case lokiRejectDeadLetter:
+
+		if this.deadLetter == nil {
+			return errors.New("dead letter writer not available")
+		}
+
+		var entries []LogEntry
+		for _, stream := range streams {
+			for _, val := range stream.Values {
+				entries = append(entries, val.entry)
+			}
+		}
+
+		return this.deadLetter.WriteBatch(ctx, entries)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package logpush
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLokiRejections(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		body        string
+		isRejection bool
+		expect      []lokiRejection
+	}{
+		{
+			name:        "distributor too old",
+			body:        "entry for stream '{app=\"foo\", env=\"prod\"}' has timestamp too old: 2024-05-07T11:28:48Z, oldest acceptable timestamp is: 2024-05-07T12:00:00Z\n",
+			isRejection: true,
+			expect: []lokiRejection{
+				{labels: `{app="foo", env="prod"}`, timestamp: time.Date(2024, 5, 7, 11, 28, 48, 0, time.UTC), coarse: true},
+			},
+		},
+		{
+			name: "distributor too old and too new",
+			body: "entry for stream '{app=\"foo\"}' has timestamp too old: 2024-05-07T11:28:48Z, oldest acceptable timestamp is: 2024-05-07T12:00:00Z\n" +
+				"entry for stream '{app=\"bar\"}' has timestamp too new: 2024-05-21T09:00:00Z\n",
+			isRejection: true,
+			expect: []lokiRejection{
+				{labels: `{app="foo"}`, timestamp: time.Date(2024, 5, 7, 11, 28, 48, 0, time.UTC), coarse: true},
+				{labels: `{app="bar"}`, timestamp: time.Date(2024, 5, 21, 9, 0, 0, 0, time.UTC), coarse: true},
+			},
+		},
+		{
+			name: "ingester out of order",
+			body: "entry with timestamp 2024-05-14 11:28:48.123456789 +0000 UTC ignored, reason: 'entry out of order',\n" +
+				"entry with timestamp 2024-05-14 11:28:48.123456790 +0000 UTC ignored, reason: 'entry out of order',\n" +
+				"user 'fake', total ignored: 2 out of 5 for stream: {app=\"foo\", level=\"info\"}\n",
+			isRejection: true,
+			expect: []lokiRejection{
+				{labels: `{app="foo", level="info"}`, timestamp: time.Date(2024, 5, 14, 11, 28, 48, 123456789, time.UTC)},
+				{labels: `{app="foo", level="info"}`, timestamp: time.Date(2024, 5, 14, 11, 28, 48, 123456790, time.UTC)},
+			},
+		},
+		{
+			name: "ingester too far behind",
+			body: "entry with timestamp 2024-05-14 10:00:00 +0000 UTC ignored, reason: 'entry too far behind, entry timestamp is: 2024-05-14T10:00:00Z, oldest acceptable timestamp is: 2024-05-14T10:30:00Z',\n" +
+				"user 'fake', total ignored: 1 out of 1 for stream: {app=\"foo\"}\n",
+			isRejection: true,
+			expect: []lokiRejection{
+				{labels: `{app="foo"}`, timestamp: time.Date(2024, 5, 14, 10, 0, 0, 0, time.UTC)},
+			},
+		},
+		{
+			name:        "rate limited",
+			body:        "Ingestion rate limit exceeded for user fake (limit: 4194304 bytes/sec) while attempting to ingest '1000' lines totaling '1048576' bytes, reduce log volume or contact your Loki administrator to see if the limit can be increased\n",
+			isRejection: false,
+		},
+		{
+			name:        "stream rate limited",
+			body:        "Per stream rate limit exceeded (limit: 3MB/sec) while attempting to ingest for stream '{app=\"foo\"}' totaling 1000B, consider splitting a stream via additional labels or contact your Loki administrator to see if the limit can be increased\n",
+			isRejection: false,
+		},
+		{
+			name:        "unknown format",
+			body:        "push rejected: entry out of order somewhere in the batch\n",
+			isRejection: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			rejections, isRejection := parseLokiRejections(test.body)
+
+			if isRejection != test.isRejection {
+				t.Fatalf("expected rejection %v, got %v", test.isRejection, isRejection)
+			}
+
+			if len(rejections) != len(test.expect) {
+				t.Fatalf("expected %d rejections, got %d: %+v", len(test.expect), len(rejections), rejections)
+			}
+
+			for idx, want := range test.expect {
+
+				got := rejections[idx]
+
+				if got.labels != want.labels || got.coarse != want.coarse || !got.timestamp.Equal(want.timestamp) {
+					t.Errorf("rejection %d: expected %+v, got %+v", idx, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitLokiRejected(t *testing.T) {
+
+	ts := time.Date(2024, 5, 14, 11, 28, 48, 123456789, time.UTC)
+
+	streams := []LokiStream{
+		{
+			Stream: map[string]string{"app": "foo"},
+			Values: []LokiStreamValue{
+				{Timestamp: ts, LogLine: "first"},
+				//	rejections refer to the timestamp as it was sent, sequence offset included
+				{Timestamp: ts, Sequence: 1, LogLine: "second"},
+				{Timestamp: ts.Add(time.Minute), LogLine: "third"},
+			},
+		},
+		{
+			Stream: map[string]string{"app": "bar"},
+			Values: []LokiStreamValue{
+				{Timestamp: ts, LogLine: "other stream"},
+				{Timestamp: ts.Add(-time.Hour), LogLine: "too old"},
+			},
+		},
+	}
+
+	rejections := []lokiRejection{
+		{labels: `{app="foo"}`, timestamp: ts.Add(1)},
+		{labels: `{app="bar"}`, timestamp: ts.Add(-time.Hour).Truncate(time.Second), coarse: true},
+	}
+
+	accepted, rejected := splitLokiRejected(streams, rejections)
+
+	lines := func(streams []LokiStream) []string {
+		var result []string
+		for _, stream := range streams {
+			for _, val := range stream.Values {
+				result = append(result, val.LogLine)
+			}
+		}
+		return result
+	}
+
+	expectLines := func(name string, got []string, want []string) {
+		if len(got) != len(want) {
+			t.Fatalf("%s: expected %v, got %v", name, want, got)
+		}
+		for idx := range want {
+			if got[idx] != want[idx] {
+				t.Fatalf("%s: expected %v, got %v", name, want, got)
+			}
+		}
+	}
+
+	expectLines("accepted", lines(accepted), []string{"first", "third", "other stream"})
+	expectLines("rejected", lines(rejected), []string{"second", "too old"})
+
+	if len(rejected) != 2 || rejected[0].Stream["app"] != "foo" || rejected[1].Stream["app"] != "bar" {
+		t.Errorf("rejected entries must keep their stream labels: %+v", rejected)
+	}
+}
@@ -0,0 +1,95 @@
+package logpush
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Used as the stream label value when a request can't be matched to a configured stream
+const metricsUnknownStream = "unknown"
+
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricIngesterRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logpush_ingester_requests_total",
+		Help: "Push requests handled by the ingester",
+	}, []string{"stream", "status"})
+
+	metricIngesterEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logpush_ingester_entries_total",
+		Help: "Log entries accepted by the ingester",
+	}, []string{"stream", "level"})
+
+	metricIngesterBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logpush_ingester_message_bytes_total",
+		Help: "Total size of accepted log messages",
+	}, []string{"stream", "level"})
+
+	metricIngesterLastEntry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "logpush_ingester_last_entry_timestamp_seconds",
+		Help: "Unix time of the last accepted push per stream",
+	}, []string{"stream"})
+
+	metricIngesterTruncations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logpush_ingester_truncations_total",
+		Help: "Data truncated by the ingester limits. Kind is one of: entries, message, metadata",
+	}, []string{"stream", "kind"})
+
+	metricIngesterAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logpush_ingester_auth_failures_total",
+		Help: "Rejected push requests due to missing or invalid credentials",
+	}, []string{"stream", "method"})
+
+	metricWriterBatchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "logpush_writer_batch_duration_seconds",
+		Help:    "Time taken by a writer to write a batch",
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"writer"})
+
+	metricWriterErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logpush_writer_errors_total",
+		Help: "Batches that a writer failed to write",
+	}, []string{"writer"})
+
+	metricLokiRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "logpush_loki_retries_total",
+		Help: "Retried loki api calls",
+	})
+
+	metricLokiCardinalityTrips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logpush_loki_cardinality_limit_trips_total",
+		Help: "Times a label was limited by the loki cardinality guard",
+	}, []string{"action"})
+
+	metricLokiRejectedEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "logpush_loki_rejected_entries_total",
+		Help: "Entries rejected by loki for being too old or out of order",
+	}, []string{"action"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricIngesterRequests,
+		metricIngesterEntries,
+		metricIngesterBytes,
+		metricIngesterLastEntry,
+		metricIngesterTruncations,
+		metricIngesterAuthFailures,
+		metricWriterBatchDuration,
+		metricWriterErrors,
+		metricLokiRetries,
+		metricLokiCardinalityTrips,
+		metricLokiRejectedEntries,
+	)
+}
+
+// Returns an http handler that exposes logpush metrics in prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
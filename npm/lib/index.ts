@@ -9,6 +9,34 @@ type BasicAuth = {
 	pass: string;
 };
 
+/**
+ * Push summary returned by the service after a successful flush
+ */
+export type PushSummary = {
+	accepted: number;
+	truncated_entries: number;
+	truncated_messages: number;
+	dropped_metadata_fields: number;
+};
+
+/**
+ * Push error returned by the service
+ */
+export class PushError extends Error {
+
+	readonly status: number;
+	readonly code: string | null;
+	readonly stream: string | null;
+
+	constructor(status: number, message: string, code?: string | null, stream?: string | null) {
+		super(message);
+		this.name = 'PushError';
+		this.status = status;
+		this.code = code || null;
+		this.stream = stream || null;
+	}
+};
+
 /**
  * Logpush agent is a class that holds instance/context level metadata, log queue and a connection to Logpush service.
  * 
@@ -69,14 +97,20 @@ export class Agent {
 		}
 	};
 
-	flush = async () => {
+	/**
+	 * Pushes all the queued entries to the service.
+	 * 
+	 * Returns a summary of what the service accepted, which includes any data truncated due to service limits.
+	 */
+	flush = async (): Promise<PushSummary | null> => {
 
 		if (!this.entries.length) {
-			return;
+			return null;
 		}
 
 		const headers = new Headers({
 			"content-type": "application/json",
+			"accept": "application/json",
 		});
 
 		if (this.auth) {
@@ -90,11 +124,29 @@ export class Agent {
 		});
 
 		if (response.ok) {
+
 			this.entries = [];
-			return;
+
+			const summary = response.headers.get('content-type')?.includes('json') ? await response.json() as PushSummary : null;
+			if (summary && (summary.truncated_entries || summary.truncated_messages || summary.dropped_metadata_fields)) {
+				console.warn(`Logpush: some log data was truncated by the service`, summary);
+			}
+
+			return summary;
+		}
+
+		const responseText = await response.text();
+
+		try {
+			const { code, message, stream } = JSON.parse(responseText);
+			throw new PushError(response.status, `Failed to flush log entries: ${message}`, code, stream);
+		} catch (error) {
+			if (error instanceof PushError) {
+				throw error;
+			}
 		}
 
-		throw new Error(`Failed to flush log entries: ${await response.text()}`);	
+		throw new PushError(response.status, `Failed to flush log entries: ${responseText}`);
 	};
 };
 
@@ -0,0 +1,225 @@
+package logpush
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidQuery = errors.New("invalid query")
+
+const (
+	queryDefaultLimit = 100
+	queryMaxLimit     = 1000
+)
+
+// Log search parameters. Results are ordered from newest to oldest
+type LogQuery struct {
+	TailFilter
+	//	Inclusive time range start; unbounded when zero
+	From time.Time
+	//	Exclusive time range end; unbounded when zero
+	To time.Time
+	//	Max number of entries to return
+	Limit int
+	//	Position to continue from, taken from a previous result
+	Cursor string
+}
+
+type LogQueryResult struct {
+	Entries []LogEntry `json:"entries"`
+	//	Empty when there are no more entries
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Parses a query from url params: from, to, limit, cursor and the filter params taken by ParseTailFilter
+func ParseLogQuery(params url.Values) (LogQuery, error) {
+
+	filter, err := ParseTailFilter(params)
+	if err != nil {
+		return LogQuery{}, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+
+	query := LogQuery{
+		TailFilter: filter,
+		Limit:      queryDefaultLimit,
+		Cursor:     params.Get("cursor"),
+	}
+
+	if query.From, err = parseQueryTime(params.Get("from")); err != nil {
+		return query, fmt.Errorf("%w: invalid 'from': %v", ErrInvalidQuery, err)
+	}
+
+	if query.To, err = parseQueryTime(params.Get("to")); err != nil {
+		return query, fmt.Errorf("%w: invalid 'to': %v", ErrInvalidQuery, err)
+	}
+
+	if val := params.Get("limit"); val != "" {
+		if query.Limit, err = strconv.Atoi(val); err != nil || query.Limit <= 0 {
+			return query, fmt.Errorf("%w: invalid 'limit'", ErrInvalidQuery)
+		}
+	}
+
+	if query.Limit > queryMaxLimit {
+		query.Limit = queryMaxLimit
+	}
+
+	if _, err := parseQueryCursor(query.Cursor); err != nil {
+		return query, err
+	}
+
+	return query, nil
+}
+
+// Accepts RFC3339 dates, unix milliseconds and durations relative to now, i.e. "15m"
+func parseQueryTime(val string) (time.Time, error) {
+
+	if val == "" {
+		return time.Time{}, nil
+	}
+
+	if ms, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+
+	if offset, err := time.ParseDuration(val); err == nil {
+		return time.Now().Add(-offset), nil
+	}
+
+	return time.Parse(time.RFC3339Nano, val)
+}
+
+// Points right after the last returned entry: its timestamp and the number of returned
+// entries that share it, as there's no other way to tell entries with the same timestamp apart
+type queryCursor struct {
+	Time time.Time
+	Skip int
+}
+
+func (this queryCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%d:%d", this.Time.UnixNano(), this.Skip))
+}
+
+func parseQueryCursor(val string) (*queryCursor, error) {
+
+	if val == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(val)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+
+	tsVal, skipVal, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+
+	ts, err := strconv.ParseInt(tsVal, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+
+	skip, err := strconv.Atoi(skipVal)
+	if err != nil || skip < 0 {
+		return nil, fmt.Errorf("%w: malformed cursor", ErrInvalidQuery)
+	}
+
+	return &queryCursor{Time: time.Unix(0, ts), Skip: skip}, nil
+}
+
+// Checks the query filter and time range against an entry
+func (this LogQuery) Match(entry LogEntry) bool {
+
+	if !this.From.IsZero() && entry.Timestamp.Before(this.From) {
+		return false
+	}
+
+	if !this.To.IsZero() && !entry.Timestamp.Before(this.To) {
+		return false
+	}
+
+	return this.TailFilter.Match(entry)
+}
+
+// Sorts entries in result order: newest first, then by tag, level and message
+// so that entries with identical timestamps keep the same order between pages
+func sortQueryEntries(entries []LogEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+
+		a, b := entries[i], entries[j]
+
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		} else if a.StreamTag != b.StreamTag {
+			return a.StreamTag < b.StreamTag
+		} else if a.LogLevel != b.LogLevel {
+			return a.LogLevel < b.LogLevel
+		}
+
+		return a.Message < b.Message
+	})
+}
+
+// Sorts matched entries and cuts out the page that the query cursor points to.
+// For readers that can't paginate on the backend side
+func pageQueryEntries(entries []LogEntry, query LogQuery) (*LogQueryResult, error) {
+
+	cursor, err := parseQueryCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = queryDefaultLimit
+	}
+
+	sortQueryEntries(entries)
+
+	if cursor != nil {
+
+		var offset int
+		for offset < len(entries) && entries[offset].Timestamp.After(cursor.Time) {
+			offset++
+		}
+
+		entries = entries[min(offset+cursor.Skip, len(entries)):]
+	}
+
+	if len(entries) > query.Limit {
+		entries = entries[:query.Limit]
+	}
+
+	return &LogQueryResult{
+		Entries:    append([]LogEntry{}, entries...),
+		NextCursor: nextQueryCursor(cursor, entries, query.Limit),
+	}, nil
+}
+
+// Returns the cursor pointing after the given page of entries
+func nextQueryCursor(prev *queryCursor, entries []LogEntry, limit int) string {
+
+	if len(entries) < limit || len(entries) == 0 {
+		return ""
+	}
+
+	last := entries[len(entries)-1].Timestamp
+
+	var skip int
+	for idx := len(entries) - 1; idx >= 0 && entries[idx].Timestamp.Equal(last); idx-- {
+		skip++
+	}
+
+	//	the whole page had the same timestamp as the previous one
+	if prev != nil && skip == len(entries) && prev.Time.Equal(last) {
+		skip += prev.Skip
+	}
+
+	return queryCursor{Time: last, Skip: skip}.String()
+}
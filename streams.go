@@ -0,0 +1,189 @@
+package logpush
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// Stream keys containing this character are treated as patterns
+const streamWildcard = "*"
+
+type streamPattern[T any] struct {
+	key    string
+	prefix string
+	suffix string
+	config T
+}
+
+func (this *streamPattern[T]) match(streamKey string) (string, bool) {
+	return matchWildcardParts(this.prefix, this.suffix, streamKey)
+}
+
+func matchWildcardParts(prefix string, suffix string, val string) (string, bool) {
+
+	if len(val) <= len(prefix)+len(suffix) {
+		return "", false
+	}
+
+	if !strings.HasPrefix(val, prefix) || !strings.HasSuffix(val, suffix) {
+		return "", false
+	}
+
+	return val[len(prefix) : len(val)-len(suffix)], true
+}
+
+// Matches a value against a single-wildcard pattern like "web-pr-*"
+func matchWildcard(pattern string, val string) bool {
+
+	prefix, suffix, isPattern := strings.Cut(pattern, streamWildcard)
+	if !isPattern {
+		return pattern == val
+	}
+
+	_, matched := matchWildcardParts(prefix, suffix, val)
+	return matched
+}
+
+func isStreamPattern(key string) bool {
+	return strings.Contains(key, streamWildcard)
+}
+
+// Collects pattern keys ordered by specificity. Also used for other options keyed by stream patterns
+func compileStreamPatterns[T any](streams map[string]T) []streamPattern[T] {
+
+	var patterns []streamPattern[T]
+
+	for key, val := range streams {
+
+		if !isStreamPattern(key) {
+			continue
+		}
+
+		if strings.Count(key, streamWildcard) > 1 {
+			slog.Warn("INGESTER Stream pattern ignored: only one wildcard is allowed",
+				slog.String("pattern", key))
+			continue
+		}
+
+		prefix, suffix, _ := strings.Cut(strings.ToLower(key), streamWildcard)
+
+		patterns = append(patterns, streamPattern[T]{
+			key:    key,
+			prefix: prefix,
+			suffix: suffix,
+			config: val,
+		})
+	}
+
+	//	the most specific patterns go first
+	sort.Slice(patterns, func(i, j int) bool {
+		if lenI, lenJ := len(patterns[i].prefix)+len(patterns[i].suffix), len(patterns[j].prefix)+len(patterns[j].suffix); lenI != lenJ {
+			return lenI > lenJ
+		}
+		return patterns[i].key < patterns[j].key
+	})
+
+	return patterns
+}
+
+// Finds a stream by its key. Static keys always take precedence over patterns.
+// Returns the stream config as well as the config key that it was matched by
+func (this *LogIngester) lookupStream(streamKey string) (StreamConfig, string, bool) {
+
+	this.streamsMtx.RLock()
+	defer this.streamsMtx.RUnlock()
+
+	if stream, has := this.Streams[streamKey]; has && !isStreamPattern(streamKey) {
+		return stream, streamKey, true
+	}
+
+	for _, pattern := range this.patterns {
+
+		matched, ok := pattern.match(streamKey)
+		if !ok {
+			continue
+		}
+
+		//	everything but the tag and labels applies to matched streams as is
+		stream := pattern.config
+		stream.Tag = strings.ReplaceAll(pattern.config.Tag, streamWildcard, matched)
+		stream.Labels = map[string]string{}
+
+		for key, val := range pattern.config.Labels {
+			stream.Labels[key] = val
+		}
+
+		if pattern.config.MatchLabel != "" {
+			stream.Labels[pattern.config.MatchLabel] = matched
+		}
+
+		return stream, pattern.key, true
+	}
+
+	return StreamConfig{}, "", false
+}
+
+// Returns a copy of all the configured streams, including patterns
+func (this *LogIngester) ListStreams() map[string]StreamConfig {
+
+	this.streamsMtx.RLock()
+	defer this.streamsMtx.RUnlock()
+
+	streams := map[string]StreamConfig{}
+	for key, val := range this.Streams {
+		streams[key] = val
+	}
+
+	return streams
+}
+
+// Returns a stream or a pattern exactly matching the key
+func (this *LogIngester) GetStream(key string) (StreamConfig, bool) {
+
+	this.streamsMtx.RLock()
+	defer this.streamsMtx.RUnlock()
+
+	stream, has := this.Streams[key]
+	return stream, has
+}
+
+// Adds or replaces a stream without interrupting the ingester
+func (this *LogIngester) SetStream(key string, stream StreamConfig) {
+
+	this.streamsMtx.Lock()
+	defer this.streamsMtx.Unlock()
+
+	streams := map[string]StreamConfig{}
+	for key, val := range this.Streams {
+		streams[key] = val
+	}
+
+	streams[key] = stream
+
+	this.Streams = streams
+	this.patterns = compileStreamPatterns(streams)
+}
+
+// Removes a stream without interrupting the ingester
+func (this *LogIngester) DeleteStream(key string) bool {
+
+	this.streamsMtx.Lock()
+	defer this.streamsMtx.Unlock()
+
+	if _, has := this.Streams[key]; !has {
+		return false
+	}
+
+	streams := map[string]StreamConfig{}
+	for streamKey, val := range this.Streams {
+		if streamKey != key {
+			streams[streamKey] = val
+		}
+	}
+
+	this.Streams = streams
+	this.patterns = compileStreamPatterns(streams)
+
+	return true
+}
@@ -0,0 +1,124 @@
+package logpush
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrStreamNotFound = errors.New("stream not found")
+
+// StreamStore persists streams managed at runtime
+type StreamStore interface {
+	Type() string
+	LoadStreams(ctx context.Context) (map[string]StreamConfig, error)
+	SaveStream(ctx context.Context, key string, stream StreamConfig) error
+	DeleteStream(ctx context.Context, key string) error
+}
+
+// Creates a stream store backed by a local json file
+func NewFileStreamStore(path string) (*fileStreamStore, error) {
+
+	if path == "" {
+		return nil, errors.New("file path is not defined")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create store directory: %v", err)
+	}
+
+	return &fileStreamStore{path: path}, nil
+}
+
+type fileStreamStore struct {
+	path string
+	mtx  sync.Mutex
+}
+
+func (this *fileStreamStore) Type() string {
+	return "file"
+}
+
+func (this *fileStreamStore) read() (map[string]StreamConfig, error) {
+
+	streams := map[string]StreamConfig{}
+
+	data, err := os.ReadFile(this.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return streams, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(data) == 0 {
+		return streams, nil
+	}
+
+	if err := json.Unmarshal(data, &streams); err != nil {
+		return nil, fmt.Errorf("failed to decode store file: %v", err)
+	}
+
+	return streams, nil
+}
+
+func (this *fileStreamStore) write(streams map[string]StreamConfig) error {
+
+	data, err := json.MarshalIndent(streams, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	//	write to a temp file first so that a crash won't leave a half-written store behind
+	tempPath := this.path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, this.path)
+}
+
+func (this *fileStreamStore) LoadStreams(ctx context.Context) (map[string]StreamConfig, error) {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	return this.read()
+}
+
+func (this *fileStreamStore) SaveStream(ctx context.Context, key string, stream StreamConfig) error {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	streams, err := this.read()
+	if err != nil {
+		return err
+	}
+
+	streams[key] = stream
+
+	return this.write(streams)
+}
+
+func (this *fileStreamStore) DeleteStream(ctx context.Context, key string) error {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	streams, err := this.read()
+	if err != nil {
+		return err
+	}
+
+	if _, has := streams[key]; !has {
+		return ErrStreamNotFound
+	}
+
+	delete(streams, key)
+
+	return this.write(streams)
+}
@@ -0,0 +1,193 @@
+package logpush
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Selects entries delivered to a tail subscription. Empty fields match everything
+type TailFilter struct {
+	//	Exact stream key. Only known for live entries, so it's not used by log search
+	Stream string
+	//	Stream tag, may contain a wildcard
+	Tag string
+	//	Allowed log levels
+	Levels []string
+	//	Metadata values that must all be present
+	Meta map[string]string
+	//	Case-sensitive message substring
+	Contains string
+}
+
+// Parses a filter from query params: tag, level (comma-separated), meta.<key> and contains
+func ParseTailFilter(query url.Values) (TailFilter, error) {
+
+	filter := TailFilter{
+		Tag:      query.Get("tag"),
+		Meta:     map[string]string{},
+		Contains: query.Get("contains"),
+	}
+
+	for _, val := range query["level"] {
+		for _, level := range strings.Split(val, ",") {
+
+			level = strings.ToLower(strings.TrimSpace(level))
+			if level == "" {
+				continue
+			}
+
+			//	unknown levels would otherwise turn into "error" and match the wrong entries
+			if LogLevel(level).String() != level {
+				return filter, fmt.Errorf("unknown log level '%s'", level)
+			}
+
+			filter.Levels = append(filter.Levels, level)
+		}
+	}
+
+	for key, val := range query {
+		if metaKey, isMeta := strings.CutPrefix(key, "meta."); isMeta && metaKey != "" && len(val) > 0 {
+			filter.Meta[metaKey] = val[0]
+		}
+	}
+
+	return filter, nil
+}
+
+func (this TailFilter) Match(entry LogEntry) bool {
+
+	if this.Stream != "" && entry.StreamKey != this.Stream {
+		return false
+	}
+
+	if this.Tag != "" && !matchWildcard(this.Tag, entry.StreamTag) {
+		return false
+	}
+
+	if len(this.Levels) > 0 {
+
+		level := entry.LogLevel.String()
+
+		var matched bool
+		for _, val := range this.Levels {
+			if val == level {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	for key, val := range this.Meta {
+		if entry.Metadata[key] != val {
+			return false
+		}
+	}
+
+	if this.Contains != "" && !strings.Contains(entry.Message, this.Contains) {
+		return false
+	}
+
+	return true
+}
+
+// TailHub fans out written entries to live subscribers.
+// Publishing never blocks: entries that don't fit into a subscriber's buffer are dropped,
+// and once a subscriber has dropped a full buffer's worth of them it's marked as too slow
+type TailHub struct {
+	mtx         sync.RWMutex
+	subscribers map[*TailSubscription]struct{}
+}
+
+type TailSubscription struct {
+	Filter   TailFilter
+	entries  chan LogEntry
+	dropped  atomic.Int64
+	slow     chan struct{}
+	slowOnce sync.Once
+}
+
+// Delivered entries. Closed when the subscription is removed
+func (this *TailSubscription) Entries() <-chan LogEntry {
+	return this.entries
+}
+
+// Number of entries dropped because the subscriber was too slow
+func (this *TailSubscription) Dropped() int64 {
+	return this.dropped.Load()
+}
+
+// Closed when the subscriber falls too far behind and should be disconnected
+func (this *TailSubscription) Slow() <-chan struct{} {
+	return this.slow
+}
+
+func (this *TailHub) Subscribe(filter TailFilter, buffer int) *TailSubscription {
+
+	if buffer <= 0 {
+		buffer = 1000
+	}
+
+	sub := &TailSubscription{
+		Filter:  filter,
+		entries: make(chan LogEntry, buffer),
+		slow:    make(chan struct{}),
+	}
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if this.subscribers == nil {
+		this.subscribers = map[*TailSubscription]struct{}{}
+	}
+
+	this.subscribers[sub] = struct{}{}
+
+	return sub
+}
+
+func (this *TailHub) Unsubscribe(sub *TailSubscription) {
+
+	this.mtx.Lock()
+	defer this.mtx.Unlock()
+
+	if _, has := this.subscribers[sub]; has {
+		delete(this.subscribers, sub)
+		close(sub.entries)
+	}
+}
+
+func (this *TailHub) Subscribers() int {
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+	return len(this.subscribers)
+}
+
+func (this *TailHub) Publish(batch []LogEntry) {
+
+	this.mtx.RLock()
+	defer this.mtx.RUnlock()
+
+	for sub := range this.subscribers {
+		for _, entry := range batch {
+
+			if !sub.Filter.Match(entry) {
+				continue
+			}
+
+			select {
+			case sub.entries <- entry:
+			default:
+				if sub.dropped.Add(1) >= int64(cap(sub.entries)) {
+					sub.slowOnce.Do(func() { close(sub.slow) })
+				}
+			}
+		}
+	}
+}
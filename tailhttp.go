@@ -0,0 +1,319 @@
+package logpush
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"math/rand"
+
+	"github.com/gorilla/websocket"
+)
+
+const tailPingInterval = 30 * time.Second
+
+var tailUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// Streams entries matching the filter until the client disconnects or falls too far behind.
+// Uses a websocket for upgrade requests, server-sent events for clients that accept text/event-stream
+// and newline-delimited json for everything else
+func serveTail(wrt http.ResponseWriter, req *http.Request, hub *TailHub, filter TailFilter) {
+
+	sub := hub.Subscribe(filter, 0)
+	defer hub.Unsubscribe(sub)
+
+	var transport string
+	var err error
+
+	switch {
+	case websocket.IsWebSocketUpgrade(req):
+		transport = "websocket"
+		err = serveTailWebSocket(wrt, req, sub)
+	case strings.Contains(req.Header.Get("accept"), "text/event-stream"):
+		transport = "sse"
+		err = serveTailEvents(wrt, req, sub)
+	default:
+		transport = "ndjson"
+		err = serveTailNDJSON(wrt, req, sub)
+	}
+
+	attrs := []any{
+		slog.String("ip", parseXff(req)),
+		slog.String("transport", transport),
+		slog.String("stream", filter.Stream),
+		slog.String("tag", filter.Tag),
+		slog.Int64("dropped", sub.Dropped()),
+	}
+
+	if err != nil {
+		attrs = append(attrs, slog.String("err", err.Error()))
+	}
+
+	slog.Info("TAIL Subscriber disconnected", attrs...)
+}
+
+var errTailTooSlow = fmt.Errorf("subscriber too slow")
+
+func serveTailNDJSON(wrt http.ResponseWriter, req *http.Request, sub *TailSubscription) error {
+
+	flusher, ok := wrt.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming not supported")
+	}
+
+	wrt.Header().Set("content-type", "application/x-ndjson")
+	wrt.Header().Set("cache-control", "no-cache")
+	wrt.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(wrt)
+
+	for {
+		select {
+
+		case <-req.Context().Done():
+			return nil
+
+		case <-sub.Slow():
+			return errTailTooSlow
+
+		case entry := <-sub.Entries():
+
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+
+			//	sends everything that's already buffered in one go
+			for pending := len(sub.Entries()); pending > 0; pending-- {
+				if err := encoder.Encode(<-sub.Entries()); err != nil {
+					return err
+				}
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+func serveTailEvents(wrt http.ResponseWriter, req *http.Request, sub *TailSubscription) error {
+
+	flusher, ok := wrt.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("streaming not supported")
+	}
+
+	wrt.Header().Set("content-type", "text/event-stream")
+	wrt.Header().Set("cache-control", "no-cache")
+	//	disables response buffering in nginx
+	wrt.Header().Set("x-accel-buffering", "no")
+	wrt.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var writeEntry = func(entry LogEntry) error {
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(wrt, "event: entry\ndata: %s\n\n", data)
+		return err
+	}
+
+	ticker := time.NewTicker(tailPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-req.Context().Done():
+			return nil
+
+		case <-sub.Slow():
+			fmt.Fprintf(wrt, "event: dropped\ndata: {\"dropped\":%d}\n\n", sub.Dropped())
+			flusher.Flush()
+			return errTailTooSlow
+
+		case <-ticker.C:
+
+			//	comments keep idle connections from being closed by proxies
+			if _, err := fmt.Fprint(wrt, ": ping\n\n"); err != nil {
+				return err
+			}
+
+			flusher.Flush()
+
+		case entry := <-sub.Entries():
+
+			if err := writeEntry(entry); err != nil {
+				return err
+			}
+
+			for pending := len(sub.Entries()); pending > 0; pending-- {
+				if err := writeEntry(<-sub.Entries()); err != nil {
+					return err
+				}
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+func serveTailWebSocket(wrt http.ResponseWriter, req *http.Request, sub *TailSubscription) error {
+
+	conn, err := tailUpgrader.Upgrade(wrt, req, nil)
+	if err != nil {
+		//	the upgrader has already responded with an error
+		return err
+	}
+	defer conn.Close()
+
+	//	the connection is write-only, but reading is still required to process control frames
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(tailPingInterval)
+	defer ticker.Stop()
+
+	const writeTimeout = 10 * time.Second
+
+	for {
+		select {
+
+		case <-closed:
+			return nil
+
+		case <-sub.Slow():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseTryAgainLater, errTailTooSlow.Error()),
+				time.Now().Add(writeTimeout))
+			return errTailTooSlow
+
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return err
+			}
+
+		case entry := <-sub.Entries():
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteJSON(entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Live tail for a single stream. Requires the stream's read token or the admin token,
+// push credentials don't grant read access
+func (this *LogIngester) ServeTail(wrt http.ResponseWriter, req *http.Request) {
+
+	if !this.optionsValid {
+		this.validateOptions()
+	}
+
+	streamKey := strings.ToLower(req.PathValue("stream_key"))
+
+	var respondError = func(code string, message string, status int) {
+
+		slog.Error("INGESTER tail request",
+			slog.String("ip", parseXff(req)),
+			slog.String("stream_id", streamKey),
+			slog.Int("status", status),
+			slog.String("err", message))
+
+		wrt.Header().Set("content-type", "application/json")
+		wrt.WriteHeader(status)
+		json.NewEncoder(wrt).Encode(IngesterError{
+			Code:    code,
+			Message: message,
+			Stream:  streamKey,
+		})
+	}
+
+	if this.Tail == nil {
+		respondError("tail_disabled", "live tail is not enabled", http.StatusNotFound)
+		return
+	}
+
+	if authErr := this.authorizeTail(req, streamKey); authErr != nil {
+		respondError(authErr.Code, authErr.Message, authErr.status)
+		return
+	}
+
+	filter, err := ParseTailFilter(req.URL.Query())
+	if err != nil {
+		respondError("invalid_filter", err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//	subscribers can only see the stream they're authorized for,
+	//	even when other streams share its tag
+	filter.Stream = streamKey
+	filter.Tag = ""
+
+	slog.Info("INGESTER Tail started",
+		slog.String("ip", parseXff(req)),
+		slog.String("stream_id", streamKey))
+
+	serveTail(wrt, req, this.Tail, filter)
+}
+
+func (this *LogIngester) authorizeTail(req *http.Request, streamKey string) *ingesterAuthError {
+
+	var authError = func(code string, message string, status int) *ingesterAuthError {
+		return &ingesterAuthError{
+			IngesterError: IngesterError{Code: code, Message: message, Stream: streamKey},
+			status:        status,
+		}
+	}
+
+	if streamKey == "" {
+		return authError("stream_required", "stream id required", http.StatusBadRequest)
+	}
+
+	if strings.Contains(streamKey, streamWildcard) {
+		return authError("invalid_stream", "stream id can't contain wildcards", http.StatusBadRequest)
+	}
+
+	stream, configKey, has := this.lookupStream(streamKey)
+	if !has {
+		return authError("stream_not_found", fmt.Sprintf("stream '%s' not found", streamKey), http.StatusNotFound)
+	}
+
+	clientToken := requestToken(req)
+
+	if this.AdminToken != "" && subtle.ConstantTimeCompare([]byte(clientToken), []byte(this.AdminToken)) == 1 {
+		return nil
+	}
+
+	if stream.ReadToken == "" {
+		metricIngesterAuthFailures.WithLabelValues(configKey, "read_token").Inc()
+		return authError("tail_forbidden", fmt.Sprintf("stream '%s' has no read token and can only be tailed with the admin token", streamKey), http.StatusForbidden)
+	}
+
+	if clientToken == "" {
+		metricIngesterAuthFailures.WithLabelValues(configKey, "read_token").Inc()
+		return authError("token_required", fmt.Sprintf("read token required for stream '%s'", streamKey), http.StatusUnauthorized)
+	} else if subtle.ConstantTimeCompare([]byte(clientToken), []byte(stream.ReadToken)) != 1 {
+		metricIngesterAuthFailures.WithLabelValues(configKey, "read_token").Inc()
+		time.Sleep(time.Duration(rand.Intn(1000)) * time.Millisecond)
+		return authError("token_rejected", fmt.Sprintf("read token rejected for stream '%s'", streamKey), http.StatusForbidden)
+	}
+
+	return nil
+}
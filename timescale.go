@@ -8,78 +8,173 @@ import (
 	"log/slog"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-type sqltx interface {
-	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
-	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
-}
+const timescaleDefaultTable = "logpush_entries"
 
-func NewTimescaleWriter(dbUrl string) (*timescaleWriter, error) {
+func NewTimescaleWriter(dbUrl string, opts TimescaleOptions) (*timescaleWriter, error) {
 
-	const version = "v2"
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 
 	db, err := sql.Open("postgres", dbUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	tableName := "logpush_entries_" + version
+	tableName := opts.tableIdent()
+
+	//	migrations may have to copy a lot of data and get a separate timeout
+	migrateCtx, cancelMigrate := context.WithTimeout(context.Background(), opts.migrationTimeout())
+	defer cancelMigrate()
+
+	//	with manual migrations enabled, only check that the schema is up to date
+	pending, err := runTimescaleMigrations(migrateCtx, db, opts, opts.ManualMigrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	} else if opts.ManualMigrations && len(pending) > 0 {
+		db.Close()
+		return nil, fmt.Errorf("schema has %d pending migrations; run 'logpush migrate' to apply them", len(pending))
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	var tableExists = func() (bool, error) {
+	if err := setupTimescaleColumns(ctx, db, opts); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	//	indexes go first as some of them can't be created once the table is compressed.
+	//	building them on a large table can take much longer than the rest of the setup
+	indexCtx, cancelIndex := context.WithTimeout(context.Background(), opts.indexTimeout())
+	defer cancelIndex()
 
-		query := fmt.Sprintf("select exists (select 1 from %s)", tableName)
+	if err := setupTimescaleIndexes(indexCtx, db, opts); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-		_, err := db.QueryContext(ctx, query)
-		if err == nil || strings.Contains(err.Error(), "does not exist") {
-			return err == nil, nil
-		}
+	//	the rest of the setup gets a fresh timeout
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
 
-		return false, err
+	if err := setupTimescaleHypertable(ctx, db, tableName, opts); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	var tableInit = func() error {
+	if err := setupTimescaleRetentionTable(ctx, db, opts); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create retention table: %v", err)
+	}
 
-		query := fmt.Sprintf(`create table %s (
-			time timestamp with time zone not null,
-			tag text not null,
-			level text not null,
-			message text not null,
-			meta jsonb null
-		)`, tableName)
+	retention, err := loadTimescaleRetention(ctx, db, opts)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load stream retention: %v", err)
+	}
 
-		_, err := db.ExecContext(ctx, query)
-		return err
+	writer := newTimescaleWriter(db, dbUrl, opts)
+	writer.retention = retention
+
+	retentionInterval := time.Duration(opts.RetentionInterval)
+	if retentionInterval <= 0 {
+		retentionInterval = time.Hour
 	}
 
-	if exists, _ := tableExists(); !exists {
+	jobCtx, jobCancel := context.WithCancel(context.Background())
+	writer.jobCancel = jobCancel
+	go writer.runRetentionJob(jobCtx, retentionInterval)
 
-		slog.Info("TIMESCALE: Setting up",
-			slog.String("table", tableName))
+	return writer, nil
+}
 
-		if err := tableInit(); err != nil {
-			db.Close()
-			return nil, err
-		}
+// Opens the entries table for queries only, without setting it up or running any background jobs
+func NewTimescaleReader(dbUrl string, opts TimescaleOptions) (*timescaleWriter, error) {
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dbUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return newTimescaleWriter(db, dbUrl, opts), nil
+}
+
+func newTimescaleWriter(db *sql.DB, dbUrl string, opts TimescaleOptions) *timescaleWriter {
+
+	columns := append([]string{}, timescaleColumns...)
+	for _, col := range opts.Columns {
+		columns = append(columns, col.columnName())
 	}
 
 	return &timescaleWriter{
-		db:      db,
-		table:   tableName,
-		version: version,
-	}, nil
+		db:             db,
+		schema:         opts.Schema,
+		tableName:      opts.tableName(),
+		tableKey:       opts.tableKey(),
+		table:          opts.tableIdent(),
+		version:        fmt.Sprintf("v%d", timescaleSchemaVersion()),
+		promoted:       opts.Columns,
+		columns:        columns,
+		insertQuery:    timescaleInsertQuery(opts.tableIdent(), columns),
+		retentionTable: opts.schemaIdent(timescaleRetentionTable),
+		retention:      map[string]timescaleRetentionPolicy{},
+		compressAfter:  opts.compressAfter(),
+		dbUrl:          dbUrl,
+		notify:         opts.Notify,
+		instanceID:     newTimescaleInstanceID(),
+	}
 }
 
 type timescaleWriter struct {
-	db      *sql.DB
-	table   string
-	version string
+	db          *sql.DB
+	schema      string
+	tableName   string
+	tableKey    string
+	table       string
+	version     string
+	promoted    []TimescaleColumn
+	columns     []string
+	insertQuery string
+
+	retentionTable string
+	retentionMtx   sync.Mutex
+	retention      map[string]timescaleRetentionPolicy
+	compressAfter  time.Duration
+	jobCancel      context.CancelFunc
+
+	dbUrl      string
+	notify     bool
+	instanceID string
+	tail       *TailHub
+	tailCancel func()
+	//	holds the tail presence lock, only used by the listener goroutine
+	tailConn    *sql.Conn
+	tailPresent atomic.Bool
+
+	listenersMtx     sync.Mutex
+	listenersChecked time.Time
+	listenersActive  bool
 }
 
 func (this *timescaleWriter) Type() string {
@@ -90,75 +185,235 @@ func (this *timescaleWriter) Version() string {
 	return this.version
 }
 
-func (this *timescaleWriter) Ping() error {
-	return this.db.Ping()
+func (this *timescaleWriter) Ping(ctx context.Context) error {
+	return this.db.PingContext(ctx)
 }
 
 func (this *timescaleWriter) Close() error {
+
+	if this.jobCancel != nil {
+		this.jobCancel()
+	}
+
+	if this.tailCancel != nil {
+		this.tailCancel()
+	}
+
 	return this.db.Close()
 }
 
 func (this *timescaleWriter) WriteEntry(ctx context.Context, entry LogEntry) error {
-	return this.writeEntryTx(ctx, this.db, entry)
+
+	if err := this.trackRetention(ctx, []LogEntry{entry}); err != nil {
+		slog.Warn("TIMESCALE: Failed to update stream retention",
+			slog.String("err", err.Error()))
+	}
+
+	row, err := this.entryRow(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := this.db.ExecContext(ctx, this.insertQuery, row...); err != nil {
+		return err
+	}
+
+	this.notifyTail(ctx, []LogEntry{entry})
+
+	return nil
 }
 
+// Writes a batch with a single COPY FROM STDIN
 func (this *timescaleWriter) WriteBatch(ctx context.Context, batch []LogEntry) error {
 
+	if len(batch) == 0 {
+		return nil
+	}
+
+	//	entries are still written without it, the next batch retries the update
+	if err := this.trackRetention(ctx, batch); err != nil {
+		slog.Warn("TIMESCALE: Failed to update stream retention",
+			slog.String("err", err.Error()))
+	}
+
 	tx, err := this.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	for _, val := range batch {
-		if err := this.writeEntryTx(ctx, tx, val); err != nil {
+	stmt, err := tx.PrepareContext(ctx, this.copyQuery())
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, entry := range batch {
+
+		row, err := this.entryRow(entry)
+		if err != nil {
+			return err
+		}
+
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
 			return err
 		}
 	}
 
-	return tx.Commit()
-}
+	//	flushes the buffered copy data
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return err
+	}
+
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 
-func (this *timescaleWriter) writeEntryTx(ctx context.Context, tx sqltx, entry LogEntry) error {
+	this.notifyTail(ctx, batch)
 
-	row := map[string]any{
-		"time":    entry.Timestamp,
-		"tag":     entry.StreamTag,
-		"level":   entry.LogLevel.String(),
-		"message": entry.Message,
-		"meta":    entry.Metadata,
+	return nil
+}
+
+func (this *timescaleWriter) copyQuery() string {
+	if this.schema == "" {
+		return pq.CopyIn(this.tableName, this.columns...)
 	}
+	return pq.CopyInSchema(this.schema, this.tableName, this.columns...)
+}
 
-	if entry.Metadata != nil {
-		data, err := json.Marshal(entry.Metadata)
+// Base entry table columns in the order that entryRow returns them in, followed by the promoted ones
+var timescaleColumns = []string{"time", "tag", "level", "message", "meta", "stream"}
+
+func (this *timescaleWriter) entryRow(entry LogEntry) ([]any, error) {
+
+	promoted, metadata := promoteTimescaleColumns(this.promoted, entry.Metadata)
+
+	var meta any
+	if metadata != nil {
+		data, err := json.Marshal(metadata)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		row["meta"] = string(data)
+		meta = string(data)
 	}
 
-	return sqlInsertContext(ctx, tx, this.table, row)
-}
+	var stream any
+	if entry.StreamKey != "" {
+		stream = entry.StreamKey
+	}
 
-func sqlInsertContext(ctx context.Context, tx sqltx, table string, row map[string]any) error {
+	return append([]any{
+		entry.Timestamp,
+		entry.StreamTag,
+		entry.LogLevel.String(),
+		entry.Message,
+		meta,
+		stream,
+	}, promoted...), nil
+}
 
-	var columns []string
-	var args []any
-	for col, val := range row {
-		columns = append(columns, col)
-		args = append(args, val)
-	}
+func timescaleInsertQuery(table string, columns []string) string {
 
+	var names []string
 	var bindvars []string
-	for idx := range columns {
+	for idx, col := range columns {
+		names = append(names, pq.QuoteIdentifier(col))
 		bindvars = append(bindvars, "$"+strconv.Itoa(idx+1))
 	}
 
-	query := fmt.Sprintf("insert into %s (%s) values (%s)",
+	return fmt.Sprintf("insert into %s (%s) values (%s)",
 		table,
-		strings.Join(columns, ", "),
+		strings.Join(names, ", "),
 		strings.Join(bindvars, ", "))
+}
+
+// Creates a stream store that keeps runtime-managed streams in the same database
+func (this *timescaleWriter) StreamStore(ctx context.Context) (*timescaleStreamStore, error) {
+
+	table := pq.QuoteIdentifier("logpush_streams")
+	if this.schema != "" {
+		table = pq.QuoteIdentifier(this.schema) + "." + table
+	}
+
+	query := fmt.Sprintf(`create table if not exists %s (
+		key text primary key,
+		config jsonb not null,
+		updated timestamp with time zone not null default now()
+	)`, table)
+
+	if _, err := this.db.ExecContext(ctx, query); err != nil {
+		return nil, err
+	}
+
+	return &timescaleStreamStore{db: this.db, table: table}, nil
+}
+
+type timescaleStreamStore struct {
+	db    *sql.DB
+	table string
+}
 
-	_, err := tx.ExecContext(ctx, query, args...)
+func (this *timescaleStreamStore) Type() string {
+	return "timescale"
+}
+
+func (this *timescaleStreamStore) LoadStreams(ctx context.Context) (map[string]StreamConfig, error) {
+
+	rows, err := this.db.QueryContext(ctx, fmt.Sprintf("select key, config from %s", this.table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	streams := map[string]StreamConfig{}
+
+	for rows.Next() {
+
+		var key string
+		var data []byte
+		if err := rows.Scan(&key, &data); err != nil {
+			return nil, err
+		}
+
+		var stream StreamConfig
+		if err := json.Unmarshal(data, &stream); err != nil {
+			return nil, fmt.Errorf("failed to decode stream '%s': %v", key, err)
+		}
+
+		streams[key] = stream
+	}
+
+	return streams, rows.Err()
+}
+
+func (this *timescaleStreamStore) SaveStream(ctx context.Context, key string, stream StreamConfig) error {
+
+	data, err := json.Marshal(stream)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(`insert into %s (key, config) values ($1, $2)
+		on conflict (key) do update set config = excluded.config, updated = now()`, this.table)
+
+	_, err = this.db.ExecContext(ctx, query, key, string(data))
 	return err
 }
+
+func (this *timescaleStreamStore) DeleteStream(ctx context.Context, key string) error {
+
+	result, err := this.db.ExecContext(ctx, fmt.Sprintf("delete from %s where key = $1", this.table), key)
+	if err != nil {
+		return err
+	}
+
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrStreamNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package logpush
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type TimescaleAggregateOptions struct {
+	//	Create the per-minute and per-hour continuous aggregates
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	//	How far back refresh policies recompute buckets to pick up late entries. Defaults to 2 hours
+	Lookback Duration `yaml:"lookback" json:"lookback"`
+}
+
+// Continuous aggregate bucket and its refresh policy
+type timescaleAggregate struct {
+	suffix   string
+	bucket   time.Duration
+	schedule time.Duration
+	//	added to the lookback so that the refresh window always covers at least two buckets
+	extraLookback time.Duration
+}
+
+var timescaleAggregates = []timescaleAggregate{
+	{suffix: "per_minute", bucket: time.Minute, schedule: time.Minute, extraLookback: 2 * time.Minute},
+	{suffix: "per_hour", bucket: time.Hour, schedule: 30 * time.Minute, extraLookback: 2 * time.Hour},
+}
+
+// Creates continuous aggregates with entry counts and message bytes by tag and level,
+// and replaces their refresh policies to match the current options
+func setupTimescaleAggregates(ctx context.Context, db *sql.DB, opts TimescaleOptions) error {
+
+	if !opts.Aggregates.Enabled {
+		return nil
+	}
+
+	lookback := time.Duration(opts.Aggregates.Lookback)
+	if lookback <= 0 {
+		lookback = 2 * time.Hour
+	}
+
+	for _, agg := range timescaleAggregates {
+
+		view := fmt.Sprintf("%s_%s", opts.tableName(), agg.suffix)
+		if opts.Schema != "" {
+			view = pq.QuoteIdentifier(opts.Schema) + "." + pq.QuoteIdentifier(view)
+		} else {
+			view = pq.QuoteIdentifier(view)
+		}
+
+		//	real-time aggregation fills in the buckets that weren't materialized yet
+		query := fmt.Sprintf(`create materialized view if not exists %s
+			with (timescaledb.continuous, timescaledb.materialized_only = false) as
+			select
+				time_bucket('%s'::interval, time) as bucket,
+				tag,
+				level,
+				count(*) as entries,
+				sum(octet_length(message)) as message_bytes
+			from %s
+			group by bucket, tag, level
+			with no data`, view, pgInterval(agg.bucket), opts.tableIdent())
+
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create continuous aggregate %s: %v", view, err)
+		}
+
+		if _, err := db.ExecContext(ctx,
+			`select remove_continuous_aggregate_policy($1::regclass, if_exists => true)`,
+			view); err != nil {
+			return fmt.Errorf("remove_continuous_aggregate_policy: %v", err)
+		}
+
+		if _, err := db.ExecContext(ctx,
+			`select add_continuous_aggregate_policy($1::regclass,
+				start_offset => $2::interval,
+				end_offset => $3::interval,
+				schedule_interval => $4::interval)`,
+			view,
+			pgInterval(lookback+agg.extraLookback),
+			pgInterval(agg.bucket),
+			pgInterval(agg.schedule)); err != nil {
+			return fmt.Errorf("add_continuous_aggregate_policy: %v", err)
+		}
+
+		slog.Info("TIMESCALE: Continuous aggregate ready",
+			slog.String("view", view),
+			slog.Duration("bucket", agg.bucket),
+			slog.Duration("lookback", lookback))
+	}
+
+	return nil
+}
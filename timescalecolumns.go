@@ -0,0 +1,165 @@
+package logpush
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Metadata key that gets its own typed column instead of being stored in meta
+type TimescaleColumn struct {
+	//	Metadata key to promote
+	Key string `yaml:"key" json:"key"`
+	//	Column name. Defaults to the key
+	Name string `yaml:"name" json:"name"`
+	//	Column type: text, int, float, bool, timestamp or inet. Defaults to text
+	Type string `yaml:"type" json:"type"`
+	//	Create a btree index on (column, time desc)
+	Index bool `yaml:"index" json:"index"`
+}
+
+func (this TimescaleColumn) columnName() string {
+	if this.Name == "" {
+		return this.Key
+	}
+	return this.Name
+}
+
+func (this TimescaleColumn) columnType() string {
+	if this.Type == "" {
+		return "text"
+	}
+	return this.Type
+}
+
+// Maps column types to their postgres types and value parsers
+var timescaleColumnTypes = map[string]struct {
+	pgType string
+	parse  func(val string) (any, error)
+}{
+	"text": {
+		pgType: "text",
+		parse:  func(val string) (any, error) { return val, nil },
+	},
+	"int": {
+		pgType: "bigint",
+		parse:  func(val string) (any, error) { return strconv.ParseInt(val, 10, 64) },
+	},
+	"float": {
+		pgType: "double precision",
+		parse:  func(val string) (any, error) { return strconv.ParseFloat(val, 64) },
+	},
+	"bool": {
+		pgType: "boolean",
+		parse:  func(val string) (any, error) { return strconv.ParseBool(val) },
+	},
+	"timestamp": {
+		pgType: "timestamp with time zone",
+		parse:  func(val string) (any, error) { return time.Parse(time.RFC3339Nano, val) },
+	},
+	"inet": {
+		pgType: "inet",
+		parse: func(val string) (any, error) {
+			addr, err := netip.ParseAddr(val)
+			if err != nil {
+				return nil, err
+			}
+			return addr.String(), nil
+		},
+	},
+}
+
+func validateTimescaleColumns(columns []TimescaleColumn) error {
+
+	names := map[string]bool{}
+	for _, val := range timescaleColumns {
+		names[val] = true
+	}
+
+	keys := map[string]bool{}
+
+	for _, col := range columns {
+
+		if col.Key == "" {
+			return fmt.Errorf("promoted column key is empty")
+		} else if keys[col.Key] {
+			return fmt.Errorf("metadata key '%s' is promoted more than once", col.Key)
+		}
+
+		if names[col.columnName()] {
+			return fmt.Errorf("column name '%s' is already used", col.columnName())
+		}
+
+		if _, has := timescaleColumnTypes[col.columnType()]; !has {
+			return fmt.Errorf("column '%s' has unknown type '%s'", col.columnName(), col.Type)
+		}
+
+		keys[col.Key] = true
+		names[col.columnName()] = true
+	}
+
+	return nil
+}
+
+// Adds promoted columns to the entries table. Existing columns are left as is
+func setupTimescaleColumns(ctx context.Context, db *sql.DB, opts TimescaleOptions) error {
+
+	for _, col := range opts.Columns {
+
+		query := fmt.Sprintf("alter table %s add column if not exists %s %s null",
+			opts.tableIdent(),
+			pq.QuoteIdentifier(col.columnName()),
+			timescaleColumnTypes[col.columnType()].pgType)
+
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to add column '%s': %v", col.columnName(), err)
+		}
+	}
+
+	return nil
+}
+
+// Splits promoted keys out of the entry metadata. Values that can't be converted to the column type stay in meta
+func promoteTimescaleColumns(columns []TimescaleColumn, meta map[string]string) ([]any, map[string]string) {
+
+	if len(columns) == 0 {
+		return nil, meta
+	}
+
+	values := make([]any, len(columns))
+	var rest map[string]string
+
+	if meta != nil {
+		rest = make(map[string]string, len(meta))
+		for key, val := range meta {
+			rest[key] = val
+		}
+	}
+
+	for idx, col := range columns {
+
+		val, has := meta[col.Key]
+		if !has {
+			continue
+		}
+
+		parsed, err := timescaleColumnTypes[col.columnType()].parse(val)
+		if err != nil {
+			continue
+		}
+
+		values[idx] = parsed
+		delete(rest, col.Key)
+	}
+
+	if len(rest) == 0 {
+		rest = nil
+	}
+
+	return values, rest
+}
@@ -0,0 +1,308 @@
+package logpush
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const timescaleMigrationsTable = "logpush_migrations"
+
+// Schema migration for the entries table. Migrations are applied in order and are never edited once released
+type timescaleMigration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, tx *sql.Tx, opts TimescaleOptions) error
+}
+
+var timescaleMigrations = []timescaleMigration{
+	{
+		Version: 1,
+		Name:    "create entries table",
+		Up: func(ctx context.Context, tx *sql.Tx, opts TimescaleOptions) error {
+
+			table := opts.tableIdent()
+
+			if exists, err := pgTableExists(ctx, tx, table); err != nil || exists {
+				return err
+			}
+
+			//	the table used to have the schema version in its name
+			if opts.tableKey() == timescaleDefaultTable {
+				if exists, err := pgTableExists(ctx, tx, "logpush_entries_v2"); err != nil {
+					return err
+				} else if exists {
+
+					if _, err := tx.ExecContext(ctx, fmt.Sprintf("alter table logpush_entries_v2 rename to %s", table)); err != nil {
+						return err
+					}
+
+					//	keeps dashboards and queries that use the old name working
+					_, err := tx.ExecContext(ctx, fmt.Sprintf("create view logpush_entries_v2 as select * from %s", table))
+					return err
+				}
+			}
+
+			_, err := tx.ExecContext(ctx, fmt.Sprintf(`create table %s (
+				time timestamp with time zone not null,
+				tag text not null,
+				level text not null,
+				message text not null,
+				meta jsonb null
+			)`, table))
+			return err
+		},
+	},
+	{
+		Version: 2,
+		Name:    "import v1 entries",
+		Up: func(ctx context.Context, tx *sql.Tx, opts TimescaleOptions) error {
+
+			//	the legacy table belongs to the default table, custom ones start empty
+			if opts.tableKey() != timescaleDefaultTable {
+				return nil
+			}
+
+			return pgCopyLegacyTable(ctx, tx, "logpush_entries_v1", opts.tableIdent())
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add stream column",
+		Up: func(ctx context.Context, tx *sql.Tx, opts TimescaleOptions) error {
+			//	streams can share a tag, so per-stream retention needs to know the exact stream
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("alter table %s add column if not exists stream text null", opts.tableIdent()))
+			return err
+		},
+	},
+}
+
+func timescaleSchemaVersion() int {
+	return timescaleMigrations[len(timescaleMigrations)-1].Version
+}
+
+type pgQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func pgTableExists(ctx context.Context, tx pgQueryer, table string) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx, "select to_regclass($1) is not null", table).Scan(&exists)
+	return exists, err
+}
+
+// Copies data from an older entries table, converting every column that both tables have into the new column type
+func pgCopyLegacyTable(ctx context.Context, tx *sql.Tx, from string, to string) error {
+
+	if exists, err := pgTableExists(ctx, tx, from); err != nil || !exists {
+		return err
+	}
+
+	var tableColumns = func(table string) (map[string]string, []string, error) {
+
+		rows, err := tx.QueryContext(ctx, `select attname, format_type(atttypid, atttypmod) from pg_attribute
+			where attrelid = $1::regclass and attnum > 0 and not attisdropped
+			order by attnum`, table)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+
+		types := map[string]string{}
+		var names []string
+
+		for rows.Next() {
+
+			var name, colType string
+			if err := rows.Scan(&name, &colType); err != nil {
+				return nil, nil, err
+			}
+
+			types[name] = colType
+			names = append(names, name)
+		}
+
+		return types, names, rows.Err()
+	}
+
+	sourceTypes, _, err := tableColumns(from)
+	if err != nil {
+		return err
+	}
+
+	targetTypes, targetNames, err := tableColumns(to)
+	if err != nil {
+		return err
+	}
+
+	var columns []string
+	var selects []string
+
+	for _, name := range targetNames {
+
+		if _, has := sourceTypes[name]; !has {
+			continue
+		}
+
+		columns = append(columns, pq.QuoteIdentifier(name))
+		selects = append(selects, fmt.Sprintf("%s::%s", pq.QuoteIdentifier(name), targetTypes[name]))
+	}
+
+	if len(columns) == 0 {
+		return fmt.Errorf("table '%s' has no columns in common with '%s'", from, to)
+	}
+
+	result, err := tx.ExecContext(ctx, fmt.Sprintf("insert into %s (%s) select %s from %s",
+		to, strings.Join(columns, ", "), strings.Join(selects, ", "), from))
+	if err != nil {
+		return err
+	}
+
+	copied, _ := result.RowsAffected()
+
+	slog.Info("TIMESCALE: Copied legacy entries",
+		slog.String("from", from),
+		slog.String("to", to),
+		slog.Int64("rows", copied))
+
+	return nil
+}
+
+// Lists migrations that weren't applied to the entries table yet. Only reads, so it doesn't need the migration lock
+func pendingTimescaleMigrations(ctx context.Context, db pgQueryer, opts TimescaleOptions) ([]timescaleMigration, error) {
+
+	migrationsTable := opts.schemaIdent(timescaleMigrationsTable)
+
+	var current int
+
+	if exists, err := pgTableExists(ctx, db, migrationsTable); err != nil {
+		return nil, err
+	} else if exists {
+		if err := db.QueryRowContext(ctx,
+			fmt.Sprintf("select coalesce(max(version), 0) from %s where table_name = $1", migrationsTable),
+			opts.tableKey()).Scan(&current); err != nil {
+			return nil, err
+		}
+	}
+
+	var pending []timescaleMigration
+	for _, migration := range timescaleMigrations {
+		if migration.Version > current {
+			pending = append(pending, migration)
+		}
+	}
+
+	return pending, nil
+}
+
+// Applies pending migrations to the entries table. Returns the ones that were (or would be, with dryRun) applied.
+// A dry run only reads the migrations table and never creates anything
+func runTimescaleMigrations(ctx context.Context, db *sql.DB, opts TimescaleOptions, dryRun bool) ([]timescaleMigration, error) {
+
+	if dryRun {
+		return pendingTimescaleMigrations(ctx, db, opts)
+	}
+
+	table := opts.tableKey()
+	migrationsTable := opts.schemaIdent(timescaleMigrationsTable)
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	//	prevents multiple instances from migrating at the same time
+	if _, err := conn.ExecContext(ctx, "select pg_advisory_lock(hashtext($1))", timescaleMigrationsTable); err != nil {
+		return nil, fmt.Errorf("failed to acquire migration lock: %v", err)
+	}
+	defer conn.ExecContext(context.Background(), "select pg_advisory_unlock(hashtext($1))", timescaleMigrationsTable)
+
+	//	the migrations table lives in the same schema as the entries table
+	if err := setupTimescaleSchema(ctx, db, opts); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`create table if not exists %s (
+		table_name text not null,
+		version integer not null,
+		name text not null,
+		applied timestamp with time zone not null default now(),
+		primary key (table_name, version)
+	)`, migrationsTable)); err != nil {
+		return nil, fmt.Errorf("failed to create migrations table: %v", err)
+	}
+
+	pending, err := pendingTimescaleMigrations(ctx, conn, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, migration := range pending {
+
+		slog.Info("TIMESCALE: Applying migration",
+			slog.String("table", table),
+			slog.Int("version", migration.Version),
+			slog.String("name", migration.Name))
+
+		if err := applyTimescaleMigration(ctx, conn, opts, migration); err != nil {
+			return pending[:idx], fmt.Errorf("migration %d (%s): %v", migration.Version, migration.Name, err)
+		}
+	}
+
+	return pending, nil
+}
+
+func applyTimescaleMigration(ctx context.Context, conn *sql.Conn, opts TimescaleOptions, migration timescaleMigration) error {
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := migration.Up(ctx, tx, opts); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		fmt.Sprintf("insert into %s (table_name, version, name) values ($1, $2, $3)", opts.schemaIdent(timescaleMigrationsTable)),
+		opts.tableKey(), migration.Version, migration.Name); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type TimescaleMigration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+}
+
+// Applies pending schema migrations, or, with dryRun set, only lists them
+func MigrateTimescale(ctx context.Context, dbUrl string, opts TimescaleOptions, dryRun bool) ([]TimescaleMigration, error) {
+
+	db, err := sql.Open("postgres", dbUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	applied, err := runTimescaleMigrations(ctx, db, opts, dryRun)
+
+	var result []TimescaleMigration
+	for _, val := range applied {
+		result = append(result, TimescaleMigration{Version: val.Version, Name: val.Name})
+	}
+
+	return result, err
+}
@@ -0,0 +1,193 @@
+package logpush
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Select expressions that turn promoted column values back into metadata strings
+var timescaleColumnSelects = map[string]string{
+	"text":      "%s",
+	"int":       "%s::text",
+	"float":     "%s::text",
+	"bool":      "%s::text",
+	"timestamp": "to_json(%s) #>> '{}'",
+	"inet":      "host(%s)",
+}
+
+func escapePgLike(val string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(val)
+}
+
+// Searches the entries table
+func (this *timescaleWriter) Query(ctx context.Context, query LogQuery) (*LogQueryResult, error) {
+
+	cursor, err := parseQueryCursor(query.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = queryDefaultLimit
+	}
+
+	var conditions []string
+	var args []any
+
+	var bind = func(val any) string {
+		args = append(args, val)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if !query.From.IsZero() {
+		conditions = append(conditions, "time >= "+bind(query.From))
+	}
+
+	if !query.To.IsZero() {
+		conditions = append(conditions, "time < "+bind(query.To))
+	}
+
+	if cursor != nil {
+		conditions = append(conditions, "time <= "+bind(cursor.Time))
+	}
+
+	if query.Tag != "" {
+		if prefix, suffix, isPattern := strings.Cut(query.Tag, streamWildcard); isPattern {
+			conditions = append(conditions, "tag like "+bind(escapePgLike(prefix)+"%"+escapePgLike(suffix)))
+		} else {
+			conditions = append(conditions, "tag = "+bind(query.Tag))
+		}
+	}
+
+	if len(query.Levels) > 0 {
+		conditions = append(conditions, "level = any("+bind(pq.Array(query.Levels))+")")
+	}
+
+	if query.Contains != "" {
+		conditions = append(conditions, "strpos(message, "+bind(query.Contains)+") > 0")
+	}
+
+	metaFilter := map[string]string{}
+
+	for key, val := range query.Meta {
+
+		promoted := false
+
+		for _, col := range this.promoted {
+
+			if col.Key != key {
+				continue
+			}
+
+			parsed, err := timescaleColumnTypes[col.columnType()].parse(val)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid value for '%s': %v", ErrInvalidQuery, key, err)
+			}
+
+			//	entries written before the key was promoted still have it in meta
+			conditions = append(conditions, fmt.Sprintf("(%s = %s or meta ->> %s = %s)",
+				pq.QuoteIdentifier(col.columnName()), bind(parsed), bind(key), bind(val)))
+
+			promoted = true
+			break
+		}
+
+		if !promoted {
+			metaFilter[key] = val
+		}
+	}
+
+	if len(metaFilter) > 0 {
+
+		data, err := json.Marshal(metaFilter)
+		if err != nil {
+			return nil, err
+		}
+
+		//	containment can use the gin index on meta
+		conditions = append(conditions, "meta @> "+bind(string(data))+"::jsonb")
+	}
+
+	columns := []string{"time", "tag", "level", "message", "meta"}
+	for _, col := range this.promoted {
+		columns = append(columns, fmt.Sprintf(timescaleColumnSelects[col.columnType()], pq.QuoteIdentifier(col.columnName())))
+	}
+
+	sqlQuery := fmt.Sprintf("select %s from %s", strings.Join(columns, ", "), this.table)
+	if len(conditions) > 0 {
+		sqlQuery += " where " + strings.Join(conditions, " and ")
+	}
+
+	//	the extra ordering keeps entries with identical timestamps in the same order between pages
+	sqlQuery += " order by time desc, tag, level, message"
+
+	if cursor != nil && cursor.Skip > 0 {
+		sqlQuery += " offset " + bind(cursor.Skip)
+	}
+
+	sqlQuery += " limit " + bind(query.Limit)
+
+	rows, err := this.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := LogQueryResult{Entries: []LogEntry{}}
+
+	for rows.Next() {
+
+		var entry LogEntry
+		var level string
+		var meta []byte
+		promoted := make([]sql.NullString, len(this.promoted))
+
+		dest := []any{&entry.Timestamp, &entry.StreamTag, &level, &entry.Message, &meta}
+		for idx := range promoted {
+			dest = append(dest, &promoted[idx])
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		entry.LogLevel = LogLevel(level)
+
+		if meta != nil {
+			if err := json.Unmarshal(meta, &entry.Metadata); err != nil {
+				return nil, fmt.Errorf("failed to decode entry meta: %v", err)
+			}
+		}
+
+		for idx, val := range promoted {
+
+			if !val.Valid {
+				continue
+			}
+
+			if entry.Metadata == nil {
+				entry.Metadata = map[string]string{}
+			}
+
+			entry.Metadata[this.promoted[idx].Key] = val.String
+		}
+
+		entry.Timestamp = entry.Timestamp.In(time.UTC)
+
+		result.Entries = append(result.Entries, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result.NextCursor = nextQueryCursor(cursor, result.Entries, query.Limit)
+
+	return &result, nil
+}
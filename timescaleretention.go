@@ -0,0 +1,243 @@
+package logpush
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Keeps per-stream retention periods so that the deletion job still knows about them after a restart
+const timescaleRetentionTable = "logpush_stream_retention"
+
+// Max number of rows removed by a single delete statement
+const timescaleRetentionBatchSize = 10000
+
+type timescaleRetentionPolicy struct {
+	Tag       string
+	Retention time.Duration
+}
+
+func setupTimescaleRetentionTable(ctx context.Context, db *sql.DB, opts TimescaleOptions) error {
+
+	_, err := db.ExecContext(ctx, fmt.Sprintf(`create table if not exists %s (
+		table_name text not null,
+		stream text not null,
+		tag text not null,
+		retention interval not null,
+		updated timestamp with time zone not null default now(),
+		primary key (table_name, stream)
+	)`, opts.schemaIdent(timescaleRetentionTable)))
+	return err
+}
+
+func loadTimescaleRetention(ctx context.Context, db *sql.DB, opts TimescaleOptions) (map[string]timescaleRetentionPolicy, error) {
+
+	rows, err := db.QueryContext(ctx,
+		fmt.Sprintf("select stream, tag, extract(epoch from retention)::bigint from %s where table_name = $1", opts.schemaIdent(timescaleRetentionTable)),
+		opts.tableKey())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := map[string]timescaleRetentionPolicy{}
+
+	for rows.Next() {
+
+		var stream string
+		var policy timescaleRetentionPolicy
+		var seconds int64
+		if err := rows.Scan(&stream, &policy.Tag, &seconds); err != nil {
+			return nil, err
+		}
+
+		policy.Retention = time.Duration(seconds) * time.Second
+		result[stream] = policy
+	}
+
+	return result, rows.Err()
+}
+
+// Records retention periods of the streams in a batch that changed since the last write
+func (this *timescaleWriter) trackRetention(ctx context.Context, batch []LogEntry) error {
+
+	this.retentionMtx.Lock()
+	defer this.retentionMtx.Unlock()
+
+	changes := map[string]timescaleRetentionPolicy{}
+	for _, entry := range batch {
+
+		if entry.StreamKey == "" {
+			continue
+		}
+
+		policy := timescaleRetentionPolicy{Tag: entry.StreamTag, Retention: entry.Retention}
+		current, has := this.retention[entry.StreamKey]
+
+		if (policy.Retention > 0 && current != policy) || (policy.Retention == 0 && has) {
+			changes[entry.StreamKey] = policy
+		}
+	}
+
+	for stream, policy := range changes {
+
+		var err error
+
+		if policy.Retention > 0 {
+			_, err = this.db.ExecContext(ctx, fmt.Sprintf(`insert into %s (table_name, stream, tag, retention) values ($1, $2, $3, $4::interval)
+				on conflict (table_name, stream) do update set tag = excluded.tag, retention = excluded.retention, updated = now()`, this.retentionTable),
+				this.tableKey, stream, policy.Tag, pgInterval(policy.Retention))
+		} else {
+			_, err = this.db.ExecContext(ctx,
+				fmt.Sprintf("delete from %s where table_name = $1 and stream = $2", this.retentionTable),
+				this.tableKey, stream)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if policy.Retention > 0 {
+			this.retention[stream] = policy
+		} else {
+			delete(this.retention, stream)
+		}
+
+		if this.compressAfter > 0 && policy.Retention > this.compressAfter {
+			slog.Warn("TIMESCALE: Stream retention is longer than compression.after; entries compressed before expiring are only removed by the table retention",
+				slog.String("stream", stream),
+				slog.Duration("retention", policy.Retention),
+				slog.Duration("compress_after", this.compressAfter))
+		}
+	}
+
+	return nil
+}
+
+// Periodically deletes entries that are past their stream's retention period
+func (this *timescaleWriter) runRetentionJob(ctx context.Context, interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+
+		if err := this.deleteExpired(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("TIMESCALE: Retention job failed",
+				slog.String("err", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Deletes expired entries in bounded batches, one chunk at a time. Compressed chunks are skipped:
+// deleting from them fails or decompresses them depending on the timescaledb version,
+// so their entries are kept until the table-wide retention drops the whole chunk
+func (this *timescaleWriter) deleteExpired(ctx context.Context) error {
+
+	//	policies recorded by other instances sharing the table are applied too
+	var minSeconds sql.NullInt64
+	if err := this.db.QueryRowContext(ctx,
+		fmt.Sprintf("select extract(epoch from min(retention))::bigint from %s where table_name = $1", this.retentionTable),
+		this.tableKey).Scan(&minSeconds); err != nil {
+		return err
+	} else if !minSeconds.Valid {
+		return nil
+	}
+
+	minRetention := time.Duration(minSeconds.Int64) * time.Second
+
+	chunks, err := this.retentionChunks(ctx, minRetention)
+	if err != nil {
+		return fmt.Errorf("failed to list chunks: %v", err)
+	}
+
+	var total int64
+
+	for _, chunk := range chunks {
+
+		//	entries written before the stream column was added are matched by tag,
+		//	using the longest retention among the streams sharing it
+		query := fmt.Sprintf(`with policy as (
+				select stream, tag, retention from %[2]s where table_name = $1
+			), legacy as (
+				select tag, max(retention) as retention from policy group by tag
+			)
+			delete from %[1]s where ctid = any(array(
+				(select entry.ctid from %[1]s entry join policy on entry.stream = policy.stream
+					where entry.time < now() - policy.retention)
+				union all
+				(select entry.ctid from %[1]s entry join legacy on entry.stream is null and entry.tag = legacy.tag
+					where entry.time < now() - legacy.retention)
+				limit $2
+			))`, chunk, this.retentionTable)
+
+		for ctx.Err() == nil {
+
+			result, err := this.db.ExecContext(ctx, query, this.tableKey, timescaleRetentionBatchSize)
+			if err != nil {
+				return fmt.Errorf("chunk %s: %v", chunk, err)
+			}
+
+			deleted, _ := result.RowsAffected()
+			total += deleted
+
+			if deleted < timescaleRetentionBatchSize {
+				break
+			}
+		}
+	}
+
+	if total > 0 {
+		slog.Info("TIMESCALE: Deleted expired entries",
+			slog.Int64("rows", total))
+	}
+
+	return ctx.Err()
+}
+
+// Lists uncompressed chunks that may have entries older than minAge.
+// On plain postgres that's the table itself. Row ids are only unique within a chunk,
+// which is why deletes go to chunks directly
+func (this *timescaleWriter) retentionChunks(ctx context.Context, minAge time.Duration) ([]string, error) {
+
+	isHypertable, err := timescaleIsHypertable(ctx, this.db, this.table)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isHypertable {
+		return []string{this.table}, nil
+	}
+
+	rows, err := this.db.QueryContext(ctx, `select format('%I.%I', chunk_schema, chunk_name) from timescaledb_information.chunks
+		where format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass
+			and not is_compressed and range_start < now() - $2::interval
+		order by range_start`,
+		this.table, pgInterval(minAge))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []string
+
+	for rows.Next() {
+
+		var chunk string
+		if err := rows.Scan(&chunk); err != nil {
+			return nil, err
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
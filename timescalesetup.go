@@ -0,0 +1,327 @@
+package logpush
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type TimescaleOptions struct {
+	//	Postgres schema for the entries table. Uses the default search path when not set
+	Schema string `yaml:"schema" json:"schema"`
+	//	Entries table name. Defaults to logpush_entries
+	Table string `yaml:"table" json:"table"`
+	//	Indexes to create: tag_time, level_time, meta. All of them are created when not set
+	Indexes []string `yaml:"indexes" json:"indexes"`
+	//	Metadata keys stored in their own typed columns
+	Columns []TimescaleColumn `yaml:"columns" json:"columns"`
+	//	Hypertable chunk interval. Defaults to 1 day
+	ChunkInterval Duration `yaml:"chunk_interval" json:"chunk_interval"`
+	//	Native compression settings
+	Compression TimescaleCompressionOptions `yaml:"compression" json:"compression"`
+	//	Drop chunks older than this. Disabled when not set
+	Retention Duration `yaml:"retention" json:"retention"`
+	//	How often entries past their stream's retention period are deleted. Defaults to 1h
+	RetentionInterval Duration `yaml:"retention_interval" json:"retention_interval"`
+	//	Don't apply schema migrations on startup, require 'logpush migrate' to be run instead
+	ManualMigrations bool `yaml:"manual_migrations" json:"manual_migrations"`
+	//	How long migrations can take on startup. Copying data from older tables can be slow, so it defaults to 1h
+	MigrationTimeout Duration `yaml:"migration_timeout" json:"migration_timeout"`
+	//	How long building indexes can take on startup. Defaults to 1h
+	IndexTimeout Duration `yaml:"index_timeout" json:"index_timeout"`
+	//	Broadcast written entries with NOTIFY so that every instance sharing the table can tail them
+	Notify bool `yaml:"notify" json:"notify"`
+	//	Pre-aggregated entry counts for dashboards
+	Aggregates TimescaleAggregateOptions `yaml:"aggregates" json:"aggregates"`
+}
+
+type TimescaleCompressionOptions struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	//	Compress chunks older than this. Defaults to 7 days
+	After Duration `yaml:"after" json:"after"`
+}
+
+func (this TimescaleOptions) migrationTimeout() time.Duration {
+	if this.MigrationTimeout <= 0 {
+		return time.Hour
+	}
+	return time.Duration(this.MigrationTimeout)
+}
+
+func (this TimescaleOptions) indexTimeout() time.Duration {
+	if this.IndexTimeout <= 0 {
+		return time.Hour
+	}
+	return time.Duration(this.IndexTimeout)
+}
+
+// Age at which chunks get compressed, zero when compression is disabled
+func (this TimescaleOptions) compressAfter() time.Duration {
+
+	if !this.Compression.Enabled {
+		return 0
+	}
+
+	if this.Compression.After <= 0 {
+		return 7 * 24 * time.Hour
+	}
+
+	return time.Duration(this.Compression.After)
+}
+
+func (this TimescaleOptions) tableName() string {
+	if this.Table == "" {
+		return timescaleDefaultTable
+	}
+	return this.Table
+}
+
+// Quoted and schema-qualified table identifier for use in queries
+func (this TimescaleOptions) tableIdent() string {
+	return this.schemaIdent(this.tableName())
+}
+
+// Quotes a relation name, qualifying it with the configured schema
+func (this TimescaleOptions) schemaIdent(name string) string {
+	if this.Schema == "" {
+		return pq.QuoteIdentifier(name)
+	}
+	return pq.QuoteIdentifier(this.Schema) + "." + pq.QuoteIdentifier(name)
+}
+
+// Table key used to track migrations
+func (this TimescaleOptions) tableKey() string {
+	if this.Schema == "" {
+		return this.tableName()
+	}
+	return this.Schema + "." + this.tableName()
+}
+
+var timescaleIndexes = map[string]string{
+	"tag_time":   "(tag, time desc)",
+	"level_time": "(level, time desc)",
+	"meta":       "using gin (meta)",
+}
+
+var timescaleDefaultIndexes = []string{"tag_time", "level_time", "meta"}
+
+func (this TimescaleOptions) validate() error {
+
+	for _, val := range this.Indexes {
+		if _, has := timescaleIndexes[val]; !has {
+			return fmt.Errorf("unknown index '%s'", val)
+		}
+	}
+
+	return validateTimescaleColumns(this.Columns)
+}
+
+// Creates indexes without blocking writes: concurrently on plain tables and a chunk at a time on hypertables,
+// which don't support concurrent builds. Can take a long time on large tables, so it gets its own timeout
+func setupTimescaleIndexes(ctx context.Context, db *sql.DB, opts TimescaleOptions) error {
+
+	indexes := opts.Indexes
+	if indexes == nil {
+		indexes = timescaleDefaultIndexes
+	}
+
+	hypertable, err := timescaleIsHypertable(ctx, db, opts.tableIdent())
+	if err != nil {
+		return fmt.Errorf("failed to check table type: %v", err)
+	}
+
+	for _, name := range indexes {
+		if err := createTimescaleIndex(ctx, db, opts, fmt.Sprintf("%s_%s_idx", opts.tableName(), name), timescaleIndexes[name], hypertable); err != nil {
+			return fmt.Errorf("failed to create index '%s': %v", name, err)
+		}
+	}
+
+	for _, col := range opts.Columns {
+
+		if !col.Index {
+			continue
+		}
+
+		//	the prefix keeps column indexes from taking the names of the built-in ones, i.e. a 'tag_time' column
+		indexName := fmt.Sprintf("%s_col_%s_idx", opts.tableName(), col.columnName())
+		definition := fmt.Sprintf("(%s, time desc)", pq.QuoteIdentifier(col.columnName()))
+
+		if err := createTimescaleIndex(ctx, db, opts, indexName, definition, hypertable); err != nil {
+			return fmt.Errorf("failed to create index on column '%s': %v", col.columnName(), err)
+		}
+	}
+
+	return nil
+}
+
+func createTimescaleIndex(ctx context.Context, db *sql.DB, opts TimescaleOptions, name string, definition string, hypertable bool) error {
+
+	//	index names are scoped to the table's schema
+	qualified := opts.schemaIdent(name)
+
+	//	an interrupted build leaves an invalid index behind that 'if not exists' would keep skipping
+	var invalid bool
+	if err := db.QueryRowContext(ctx, "select exists (select 1 from pg_index where indexrelid = to_regclass($1) and not indisvalid)", qualified).Scan(&invalid); err != nil {
+		return err
+	}
+
+	if invalid {
+
+		slog.Warn("TIMESCALE: Rebuilding invalid index",
+			slog.String("index", name))
+
+		if _, err := db.ExecContext(ctx, fmt.Sprintf("drop index if exists %s", qualified)); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("TIMESCALE: Building index",
+		slog.String("index", name),
+		slog.String("table", opts.tableKey()))
+
+	var query string
+	if hypertable {
+		query = fmt.Sprintf("create index if not exists %s on %s %s with (timescaledb.transaction_per_chunk)", pq.QuoteIdentifier(name), opts.tableIdent(), definition)
+	} else {
+		query = fmt.Sprintf("create index concurrently if not exists %s on %s %s", pq.QuoteIdentifier(name), opts.tableIdent(), definition)
+	}
+
+	_, err := db.ExecContext(ctx, query)
+	return err
+}
+
+// Creates the configured schema. Doesn't touch the search path as the table is always referenced with its schema
+func setupTimescaleSchema(ctx context.Context, db *sql.DB, opts TimescaleOptions) error {
+
+	if opts.Schema == "" {
+		return nil
+	}
+
+	if _, err := db.ExecContext(ctx, fmt.Sprintf("create schema if not exists %s", pq.QuoteIdentifier(opts.Schema))); err != nil {
+		return fmt.Errorf("failed to create schema '%s': %v", opts.Schema, err)
+	}
+
+	return nil
+}
+
+// Formats a duration as a postgres interval
+func pgInterval(val time.Duration) string {
+	return fmt.Sprintf("%d seconds", int64(val.Seconds()))
+}
+
+func timescaleExtensionAvailable(ctx context.Context, db *sql.DB) (bool, error) {
+	var exists bool
+	err := db.QueryRowContext(ctx, "select exists (select 1 from pg_extension where extname = 'timescaledb')").Scan(&exists)
+	return exists, err
+}
+
+func timescaleIsHypertable(ctx context.Context, db *sql.DB, table string) (bool, error) {
+
+	if available, err := timescaleExtensionAvailable(ctx, db); err != nil || !available {
+		return false, err
+	}
+
+	var exists bool
+	err := db.QueryRowContext(ctx,
+		`select exists (select 1 from timescaledb_information.hypertables where format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass)`,
+		table).Scan(&exists)
+	return exists, err
+}
+
+// Turns the entries table into a hypertable and applies compression and retention policies.
+// Safe to run on every startup; does nothing on vanilla postgres
+func setupTimescaleHypertable(ctx context.Context, db *sql.DB, table string, opts TimescaleOptions) error {
+
+	available, err := timescaleExtensionAvailable(ctx, db)
+	if err != nil {
+		return fmt.Errorf("failed to check timescaledb extension: %v", err)
+	} else if !available {
+		slog.Warn("TIMESCALE: timescaledb extension is not installed, running on plain postgres without hypertables",
+			slog.String("table", table))
+		return nil
+	}
+
+	chunkInterval := time.Duration(opts.ChunkInterval)
+	if chunkInterval <= 0 {
+		chunkInterval = 24 * time.Hour
+	}
+
+	if _, err := db.ExecContext(ctx,
+		`select create_hypertable($1::regclass, 'time', chunk_time_interval => $2::interval, if_not_exists => true, migrate_data => true)`,
+		table, pgInterval(chunkInterval)); err != nil {
+		return fmt.Errorf("create_hypertable: %v", err)
+	}
+
+	//	only affects new chunks
+	if _, err := db.ExecContext(ctx,
+		`select set_chunk_time_interval($1::regclass, $2::interval)`,
+		table, pgInterval(chunkInterval)); err != nil {
+		return fmt.Errorf("set_chunk_time_interval: %v", err)
+	}
+
+	if _, err := db.ExecContext(ctx,
+		`select remove_compression_policy($1::regclass, if_exists => true)`,
+		table); err != nil {
+		return fmt.Errorf("remove_compression_policy: %v", err)
+	}
+
+	if opts.Compression.Enabled {
+
+		var compressionEnabled bool
+		if err := db.QueryRowContext(ctx,
+			`select coalesce(bool_or(compression_enabled), false) from timescaledb_information.hypertables where format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass`,
+			table).Scan(&compressionEnabled); err != nil {
+			return fmt.Errorf("failed to check compression state: %v", err)
+		}
+
+		if !compressionEnabled {
+
+			query := fmt.Sprintf(`alter table %s set (
+				timescaledb.compress,
+				timescaledb.compress_segmentby = 'tag, level',
+				timescaledb.compress_orderby = 'time desc'
+			)`, table)
+
+			if _, err := db.ExecContext(ctx, query); err != nil {
+				return fmt.Errorf("failed to enable compression: %v", err)
+			}
+		}
+
+		if _, err := db.ExecContext(ctx,
+			`select add_compression_policy($1::regclass, compress_after => $2::interval)`,
+			table, pgInterval(opts.compressAfter())); err != nil {
+			return fmt.Errorf("add_compression_policy: %v", err)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx,
+		`select remove_retention_policy($1::regclass, if_exists => true)`,
+		table); err != nil {
+		return fmt.Errorf("remove_retention_policy: %v", err)
+	}
+
+	if opts.Retention > 0 {
+		if _, err := db.ExecContext(ctx,
+			`select add_retention_policy($1::regclass, drop_after => $2::interval)`,
+			table, pgInterval(time.Duration(opts.Retention))); err != nil {
+			return fmt.Errorf("add_retention_policy: %v", err)
+		}
+	}
+
+	if err := setupTimescaleAggregates(ctx, db, opts); err != nil {
+		return err
+	}
+
+	slog.Info("TIMESCALE: Hypertable ready",
+		slog.String("table", table),
+		slog.Duration("chunk_interval", chunkInterval),
+		slog.Bool("compression", opts.Compression.Enabled),
+		slog.Duration("retention", time.Duration(opts.Retention)),
+		slog.Bool("aggregates", opts.Aggregates.Enabled))
+
+	return nil
+}
@@ -0,0 +1,336 @@
+package logpush
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Postgres limits notification payloads to 8000 bytes
+const timescaleNotifyPayloadLimit = 7900
+
+// Max number of notifications sent per batch; the tail is best-effort, so the rest of a large batch is skipped
+const timescaleNotifyMaxPayloads = 4
+
+// Instances with tail subscribers hold a shared advisory lock on this class and the channel key,
+// which lets writers skip notifications when nobody would receive them
+const timescaleTailLockClass = 0x6c70
+
+const (
+	timescaleTailPresenceInterval = 2 * time.Second
+	timescaleTailListenersTTL     = 5 * time.Second
+)
+
+func timescaleTailLockKey(channel string) int32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(channel))
+	return int32(hash.Sum32() & 0x7fffffff)
+}
+
+type timescaleNotification struct {
+	Instance string            `json:"instance"`
+	Entries  []json.RawMessage `json:"entries"`
+}
+
+// Entries are sent along with their stream key so that per-stream tails work across instances
+type timescaleNotifyEntry struct {
+	LogEntry
+	Stream string `json:"stream,omitempty"`
+}
+
+func newTimescaleInstanceID() string {
+	buff := make([]byte, 8)
+	rand.Read(buff)
+	return hex.EncodeToString(buff)
+}
+
+// Splits a batch into notification payloads that fit into the postgres limit.
+// Messages of entries that don't fit on their own are truncated
+func timescaleNotifyPayloads(instance string, batch []LogEntry) ([]string, error) {
+
+	prefix := fmt.Sprintf(`{"instance":%q,"entries":[`, instance)
+	const suffix = `]}`
+
+	maxEntrySize := timescaleNotifyPayloadLimit - len(prefix) - len(suffix)
+
+	var payloads []string
+	var buff bytes.Buffer
+
+	for _, entry := range batch {
+
+		data, err := json.Marshal(timescaleNotifyEntry{LogEntry: entry, Stream: entry.StreamKey})
+		if err != nil {
+			return nil, err
+		}
+
+		if overflow := len(data) - maxEntrySize; overflow > 0 {
+
+			//	escaping makes the encoded message longer than the original one, so this has to be repeated
+			for overflow > 0 && entry.Message != "" {
+
+				keep := len(entry.Message) - overflow - len("...")
+				if keep <= 0 {
+					keep = len(entry.Message) / 2
+				}
+
+				if keep <= len("...") {
+					entry.Message = ""
+				} else {
+					entry.Message = entry.Message[:keep] + "..."
+				}
+
+				if data, err = json.Marshal(timescaleNotifyEntry{LogEntry: entry, Stream: entry.StreamKey}); err != nil {
+					return nil, err
+				}
+
+				overflow = len(data) - maxEntrySize
+			}
+
+			//	too much metadata to fit anything in
+			if overflow > 0 {
+				continue
+			}
+		}
+
+		if buff.Len() > 0 && buff.Len()+1+len(data) > maxEntrySize {
+			payloads = append(payloads, prefix+buff.String()+suffix)
+			buff.Reset()
+		}
+
+		if buff.Len() > 0 {
+			buff.WriteByte(',')
+		}
+
+		buff.Write(data)
+	}
+
+	if buff.Len() > 0 {
+		payloads = append(payloads, prefix+buff.String()+suffix)
+	}
+
+	return payloads, nil
+}
+
+// Broadcasts stored entries to other instances. Only called after the entries are committed,
+// and failures are only logged as the tail must never cost any entries
+func (this *timescaleWriter) notifyTail(ctx context.Context, batch []LogEntry) {
+
+	if !this.notify || len(batch) == 0 {
+		return
+	}
+
+	if listening, err := this.hasTailListeners(ctx); err != nil {
+		slog.Warn("TIMESCALE: Failed to check for tail listeners",
+			slog.String("err", err.Error()))
+		return
+	} else if !listening {
+		return
+	}
+
+	if err := this.sendNotifications(ctx, batch); err != nil {
+		slog.Warn("TIMESCALE: Failed to send notifications",
+			slog.String("err", err.Error()))
+	}
+}
+
+// Checks whether any other instance has tail subscribers. The result is cached for a few seconds
+func (this *timescaleWriter) hasTailListeners(ctx context.Context) (bool, error) {
+
+	this.listenersMtx.Lock()
+	defer this.listenersMtx.Unlock()
+
+	if time.Since(this.listenersChecked) < timescaleTailListenersTTL {
+		return this.listenersActive, nil
+	}
+
+	var holders int
+	if err := this.db.QueryRowContext(ctx, `select count(*) from pg_locks
+		where locktype = 'advisory' and classid = $1 and objid = $2 and objsubid = 2 and granted`,
+		timescaleTailLockClass, timescaleTailLockKey(this.tableKey)).Scan(&holders); err != nil {
+		return false, err
+	}
+
+	//	this instance's own subscribers are served by the ingester
+	if this.tailPresent.Load() {
+		holders--
+	}
+
+	this.listenersActive = holders > 0
+	this.listenersChecked = time.Now()
+
+	return this.listenersActive, nil
+}
+
+func (this *timescaleWriter) sendNotifications(ctx context.Context, batch []LogEntry) error {
+
+	payloads, err := timescaleNotifyPayloads(this.instanceID, batch)
+	if err != nil {
+		return err
+	}
+
+	if len(payloads) > timescaleNotifyMaxPayloads {
+		slog.Debug("TIMESCALE: Batch is too large to be fully sent to the tail",
+			slog.Int("payloads", len(payloads)),
+			slog.Int("sent", timescaleNotifyMaxPayloads))
+		payloads = payloads[:timescaleNotifyMaxPayloads]
+	}
+
+	for _, payload := range payloads {
+		if _, err := this.db.ExecContext(ctx, "select pg_notify($1, $2)", this.tableKey, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Holds the tail presence lock while the hub has subscribers.
+// Only called from the listener goroutine
+func (this *timescaleWriter) syncTailPresence(ctx context.Context) {
+
+	wanted := this.tail.Subscribers() > 0
+
+	//	the lock is gone along with the session if the connection was lost
+	if this.tailConn != nil && (!wanted || this.tailConn.PingContext(ctx) != nil) {
+		this.releaseTailPresence()
+	}
+
+	if !wanted || this.tailConn != nil {
+		return
+	}
+
+	conn, err := this.db.Conn(ctx)
+	if err != nil {
+		slog.Warn("TIMESCALE: Failed to acquire tail presence connection",
+			slog.String("err", err.Error()))
+		return
+	}
+
+	if _, err := conn.ExecContext(ctx, "select pg_advisory_lock_shared($1, $2)",
+		timescaleTailLockClass, timescaleTailLockKey(this.tableKey)); err != nil {
+		slog.Warn("TIMESCALE: Failed to announce tail presence",
+			slog.String("err", err.Error()))
+		conn.Close()
+		return
+	}
+
+	this.tailConn = conn
+	this.tailPresent.Store(true)
+}
+
+func (this *timescaleWriter) releaseTailPresence() {
+
+	if this.tailConn == nil {
+		return
+	}
+
+	//	discarding the connection ends the session and releases the lock with it
+	this.tailConn.Raw(func(any) error {
+		return driver.ErrBadConn
+	})
+
+	this.tailConn.Close()
+	this.tailConn = nil
+	this.tailPresent.Store(false)
+}
+
+// Publishes entries written by other instances sharing the same table to the hub.
+// Entries received by this instance are published by the ingester. Does nothing unless notify is enabled
+func (this *timescaleWriter) Tail(hub *TailHub) error {
+
+	if !this.notify {
+		return nil
+	}
+
+	this.tail = hub
+
+	listener := pq.NewListener(this.dbUrl, 5*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Warn("TIMESCALE: Notification listener error",
+				slog.String("err", err.Error()))
+		}
+	})
+
+	if err := listener.Listen(this.tableKey); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to listen for notifications: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	this.tailCancel = func() {
+		cancel()
+		listener.Close()
+	}
+
+	go this.listen(ctx, listener)
+
+	return nil
+}
+
+func (this *timescaleWriter) listen(ctx context.Context, listener *pq.Listener) {
+
+	defer this.releaseTailPresence()
+
+	presenceTicker := time.NewTicker(timescaleTailPresenceInterval)
+	defer presenceTicker.Stop()
+
+	//	keeps idle connections from being dropped by proxies and firewalls
+	pingTicker := time.NewTicker(90 * time.Second)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+
+		case <-ctx.Done():
+			return
+
+		case <-presenceTicker.C:
+			this.syncTailPresence(ctx)
+
+		case notification, ok := <-listener.Notify:
+
+			if !ok {
+				return
+			}
+
+			//	the connection was re-established; whatever was sent in between is lost
+			if notification == nil {
+				continue
+			}
+
+			var payload timescaleNotification
+			if err := json.Unmarshal([]byte(notification.Extra), &payload); err != nil {
+				slog.Warn("TIMESCALE: Invalid notification payload",
+					slog.String("err", err.Error()))
+				continue
+			}
+
+			if payload.Instance == this.instanceID {
+				continue
+			}
+
+			var batch []LogEntry
+			for _, val := range payload.Entries {
+				var entry timescaleNotifyEntry
+				if err := json.Unmarshal(val, &entry); err == nil {
+					entry.LogEntry.StreamKey = entry.Stream
+					batch = append(batch, entry.LogEntry)
+				}
+			}
+
+			this.tail.Publish(batch)
+
+		case <-pingTicker.C:
+			go listener.Ping()
+		}
+	}
+}